@@ -0,0 +1,376 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The cacheprog command implements the protocol the go command uses to
+// talk to an external build cache named by GOCACHEPROG. The go command
+// writes JSON requests to our stdin and reads JSON responses from our
+// stdout. A "put" request is followed by its body, encoded as a JSON
+// string. Responses carry the ID of their request and begin with an
+// unsolicited response (ID 0) listing the supported commands.
+//
+// An action ID maps to an output ID, and an output ID to the bytes of
+// the output, just as in GOCACHE. In the store these are kept in
+// entries named "<action ID>-a" and "<output ID>-d", without the
+// metadata and checksums of package entries. The go command reads
+// outputs directly from disk, so outputs are also kept in a local
+// directory.
+
+// A progRequest is a request from the go command.
+type progRequest struct {
+	ID       int64
+	Command  string
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+}
+
+// A progResponse is a response to the go command.
+type progResponse struct {
+	ID            int64
+	Err           string     `json:",omitempty"`
+	KnownCommands []string   `json:",omitempty"`
+	Miss          bool       `json:",omitempty"`
+	OutputID      []byte     `json:",omitempty"`
+	Size          int64      `json:",omitempty"`
+	Time          *time.Time `json:",omitempty"`
+	DiskPath      string     `json:",omitempty"`
+}
+
+// A progAction is the contents of an action entry in the store.
+type progAction struct {
+	OutputID string
+	Size     int64
+	Time     time.Time
+}
+
+func progActionKey(actionID []byte) string {
+	return hex.EncodeToString(actionID) + "-a"
+}
+
+func progOutputKey(outputID []byte) string {
+	return hex.EncodeToString(outputID) + "-d"
+}
+
+// cacheProg serves GOCACHEPROG requests from a Store.
+type cacheProg struct {
+	store Store
+	dir   string // local directory holding outputs
+}
+
+func (c *cacheProg) get(req *progRequest) (*progResponse, error) {
+	b, err := getBytes(c.store, progActionKey(req.ActionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &progResponse{Miss: true}, nil
+		}
+		return nil, err
+	}
+	var a progAction
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+	outputID, err := hex.DecodeString(a.OutputID)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(c.dir, progOutputKey(outputID))
+	if fi, err := os.Stat(path); err != nil || fi.Size() != a.Size {
+		// Get leaves an existing file alone, so fetch next to path and
+		// replace it.
+		tmp, err := ioutil.TempDir(c.dir, tempPrefix)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		fetched := filepath.Join(tmp, progOutputKey(outputID))
+		if err := c.store.Get(progOutputKey(outputID), fetched); err != nil {
+			if os.IsNotExist(err) {
+				// The action outlived its output.
+				return &progResponse{Miss: true}, nil
+			}
+			return nil, err
+		}
+		// Outputs are kept without checksums: an output ID is
+		// already the hash of the output.
+		if sum, err := fileChecksum(fetched); err != nil {
+			return nil, err
+		} else if len(outputID) == sha256.Size && sum != hex.EncodeToString(outputID) {
+			log.Printf("%s: output does not match its ID, quarantining", progOutputKey(outputID))
+			if err := quarantine(c.store, progOutputKey(outputID)); err != nil {
+				log.Printf("%s: unable to quarantine: %s", progOutputKey(outputID), err)
+			}
+			return &progResponse{Miss: true}, nil
+		}
+		if err := os.Rename(fetched, path); err != nil {
+			return nil, err
+		}
+	}
+	return &progResponse{
+		OutputID: outputID,
+		Size:     a.Size,
+		Time:     &a.Time,
+		DiskPath: path,
+	}, nil
+}
+
+// put stores the output read from body, which is decoded as it is
+// read rather than held in memory.
+func (c *cacheProg) put(req *progRequest, body io.Reader) (*progResponse, error) {
+	key := progOutputKey(req.OutputID)
+	path := filepath.Join(c.dir, key)
+
+	// The output is written to a temporary file and only renamed into
+	// place once its size and hash have been checked. If it is already
+	// on disk the body is only hashed.
+	h := sha256.New()
+	w := io.Writer(h)
+	var f *os.File
+	if !exists(path) {
+		var err error
+		if f, err = ioutil.TempFile(c.dir, tempPrefix+key+"-"); err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		w = io.MultiWriter(f, h)
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return nil, err
+	}
+	if n != req.BodySize {
+		return nil, fmt.Errorf("put: expected %d bytes, got %d", req.BodySize, n)
+	}
+	if sum := h.Sum(nil); len(req.OutputID) == len(sum) && !bytes.Equal(sum, req.OutputID) {
+		return nil, fmt.Errorf("put: output ID does not match body")
+	}
+	if f != nil {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			return nil, err
+		}
+		if err := syncDir(c.dir); err != nil {
+			return nil, err
+		}
+	}
+
+	ok, err := c.store.Has(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := c.store.Put(key, path); err != nil {
+			return nil, err
+		}
+	}
+
+	a := progAction{
+		OutputID: hex.EncodeToString(req.OutputID),
+		Size:     req.BodySize,
+		Time:     time.Now(),
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := putBytes(c.store, progActionKey(req.ActionID), b); err != nil {
+		return nil, err
+	}
+	return &progResponse{DiskPath: path}, nil
+}
+
+// A quotedReader reads the contents of a JSON string from r up to its
+// closing quote, which it consumes. The opening quote must already
+// have been read.
+type quotedReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (q *quotedReader) Read(p []byte) (int, error) {
+	if q.done {
+		return 0, io.EOF
+	}
+	if _, err := q.r.Peek(1); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	buf, _ := q.r.Peek(q.r.Buffered())
+	end := bytes.IndexByte(buf, '"')
+	if end >= 0 {
+		buf = buf[:end]
+	}
+	n := copy(p, buf)
+	_, _ = q.r.Discard(n)
+	if n == end {
+		_, _ = q.r.Discard(1)
+		q.done = true
+		if n == 0 {
+			return 0, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// readBody returns a reader for the body of a put request: a JSON
+// string holding the body in base64, which the go command sends after
+// the request.
+func readBody(r *bufio.Reader) (io.Reader, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			return base64.NewDecoder(base64.StdEncoding, &quotedReader{r: r}), nil
+		}
+		return nil, fmt.Errorf("put: body is not a JSON string")
+	}
+}
+
+// run reads requests from r and writes responses to w until the go
+// command sends "close" or closes r. The go command writes each
+// request on a line of its own.
+func (c *cacheProg) run(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	respond := func(resp *progResponse) error {
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	if err := respond(&progResponse{KnownCommands: []string{"get", "put", "close"}}); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var req progRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return err
+		}
+
+		var resp *progResponse
+		switch req.Command {
+		case "get":
+			resp, err = c.get(&req)
+		case "put":
+			body := io.Reader(bytes.NewReader(nil))
+			if req.BodySize > 0 {
+				if body, err = readBody(br); err != nil {
+					return err
+				}
+			}
+			resp, err = c.put(&req, body)
+			// Skip whatever put did not read, so that the next
+			// request is read from the right place.
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return err
+			}
+		case "close":
+			return respond(&progResponse{ID: req.ID})
+		default:
+			err = fmt.Errorf("unknown command %q", req.Command)
+		}
+		if err != nil {
+			log.Printf("%s: %s", req.Command, err)
+			resp = &progResponse{Err: err.Error()}
+		}
+		resp.ID = req.ID
+		if err := respond(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func cacheprog(args []string) {
+	flags := flag.NewFlagSet("cacheprog", flag.ExitOnError)
+	dir := flags.String("dir", "", "local directory for outputs read by the go command (default: user cache directory)")
+	_ = flags.Parse(args)
+
+	if *dir == "" {
+		d, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*dir = filepath.Join(d, "build-cache", "cacheprog")
+	}
+	// The go command reads outputs from the DiskPath of responses,
+	// which it resolves against its own working directory.
+	var err error
+	if *dir, err = filepath.Abs(*dir); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	// GOCACHEPROG entries use the underlying store: they are not
+	// packages, so they get no metadata, and outputs are named by
+	// their own hash, so they need no checksums.
+	s, err := openStore(cacheLocation())
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &cacheProg{store: s, dir: *dir}
+	defer lockStore(c.store, false)()
+	if err := c.run(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
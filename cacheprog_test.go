@@ -0,0 +1,198 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCacheProg(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	output := []byte(strings.Repeat("output ", 10000))
+	outputID := sha256.Sum256(output)
+	actionID := sha256.Sum256([]byte("action"))
+	otherID := sha256.Sum256([]byte("other"))
+	body := func(b []byte) string {
+		return `"` + base64.StdEncoding.EncodeToString(b) + `"` + "\n"
+	}
+	request := func(req progRequest) string {
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b) + "\n"
+	}
+
+	testCases := []struct {
+		in   string
+		want progResponse
+	}{
+		{request(progRequest{ID: 1, Command: "get", ActionID: actionID[:]}),
+			progResponse{ID: 1, Miss: true}},
+		{request(progRequest{ID: 2, Command: "put", ActionID: actionID[:], OutputID: outputID[:], BodySize: int64(len(output))}) + body(output),
+			progResponse{ID: 2, DiskPath: filepath.Join(tmp, "out", progOutputKey(outputID[:]))}},
+		{request(progRequest{ID: 3, Command: "get", ActionID: actionID[:]}),
+			progResponse{ID: 3, OutputID: outputID[:], Size: int64(len(output)), DiskPath: filepath.Join(tmp, "out", progOutputKey(outputID[:]))}},
+		{request(progRequest{ID: 4, Command: "put", ActionID: otherID[:], OutputID: otherID[:], BodySize: 3}) + body([]byte("bad")),
+			progResponse{ID: 4, Err: "put: output ID does not match body"}},
+		{request(progRequest{ID: 5, Command: "put", ActionID: otherID[:], OutputID: otherID[:], BodySize: 4}) + body([]byte("bad")),
+			progResponse{ID: 5, Err: "put: expected 4 bytes, got 3"}},
+		{request(progRequest{ID: 6, Command: "get", ActionID: otherID[:]}),
+			progResponse{ID: 6, Miss: true}},
+		{request(progRequest{ID: 7, Command: "delete"}),
+			progResponse{ID: 7, Err: `unknown command "delete"`}},
+		{request(progRequest{ID: 8, Command: "close"}),
+			progResponse{ID: 8}},
+		{request(progRequest{ID: 9, Command: "get", ActionID: actionID[:]}),
+			progResponse{}},
+	}
+	var in strings.Builder
+	for _, c := range testCases {
+		in.WriteString(c.in)
+	}
+
+	c := &cacheProg{store: newDirStore(filepath.Join(tmp, "cache")), dir: filepath.Join(tmp, "out")}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := c.run(strings.NewReader(in.String()), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(nil, 1<<20)
+	var resps []progResponse
+	for scanner.Scan() {
+		var resp progResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		resps = append(resps, resp)
+	}
+	if len(resps) == 0 || len(resps[0].KnownCommands) == 0 {
+		t.Fatalf("no initial response listing the known commands: %+v", resps)
+	}
+	resps = resps[1:]
+	for i, c := range testCases {
+		if c.want.ID == 0 {
+			if i < len(resps) {
+				t.Errorf("response after close: %+v", resps[i:])
+			}
+			break
+		}
+		if i >= len(resps) {
+			t.Fatalf("no response to %s", c.in)
+		}
+		got := resps[i]
+		got.Time = nil
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("response to %s = %+v, want %+v", strings.SplitN(c.in, "\n", 2)[0], got, c.want)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, progOutputKey(outputID[:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, output) {
+		t.Errorf("output on disk does not match the body put")
+	}
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("%d files in %s, want only the output", len(infos), c.dir)
+	}
+
+	// The store holds the action and the output, without sidecars.
+	entries, err := c.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	want := []string{progActionKey(actionID[:]), progOutputKey(outputID[:])}
+	sort.Strings(want)
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("store holds %q, want %q", keys, want)
+	}
+
+	// An output which no longer matches its ID is a miss.
+	if err := os.Remove(filepath.Join(c.dir, progOutputKey(outputID[:]))); err != nil {
+		t.Fatal(err)
+	}
+	stored := filepath.Join(tmp, "cache", progOutputKey(outputID[:])[:2], progOutputKey(outputID[:]))
+	if err := ioutil.WriteFile(stored, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.get(&progRequest{Command: "get", ActionID: actionID[:]})
+	if err != nil || !resp.Miss {
+		t.Errorf("get of a corrupt output = %+v, %v; want a miss", resp, err)
+	}
+	if exists(filepath.Join(c.dir, progOutputKey(outputID[:]))) {
+		t.Errorf("corrupt output was handed to the go command")
+	}
+}
+
+func TestQuotedReader(t *testing.T) {
+	testCases := []struct {
+		in, want, rest string
+	}{
+		{`"`, "", ""},
+		{`abc"`, "abc", ""},
+		{`abc"` + "\n{}", "abc", "\n{}"},
+		{strings.Repeat("a", 10000) + `"rest`, strings.Repeat("a", 10000), "rest"},
+	}
+	for _, c := range testCases {
+		r := bufio.NewReaderSize(strings.NewReader(c.in), 16)
+		got, err := ioutil.ReadAll(&quotedReader{r: r})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.want || string(rest) != c.rest {
+			t.Errorf("%.20q: read %.20q leaving %q, want %.20q leaving %q", c.in, got, rest, c.want, c.rest)
+		}
+	}
+
+	r := bufio.NewReader(strings.NewReader("abc"))
+	if _, err := ioutil.ReadAll(&quotedReader{r: r}); err == nil {
+		t.Errorf("unterminated string read without error")
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A codec compresses and decompresses cache entries.
+type codec struct {
+	magic      []byte // the first bytes of the compressed data
+	compress   func(w io.Writer) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+	available  func() error // nil if the codec can be used
+}
+
+// codecs maps the name of a compression format, as recorded in entry
+// headers and metadata, to its codec. The standard library has no zstd
+// package, so zstd runs the zstd command.
+var codecs = map[string]codec{
+	"gzip": {
+		magic: []byte{0x1f, 0x8b},
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		available: func() error { return nil },
+	},
+	"zstd": {
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return startFilter(w, "zstd", "-q", "-c")
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			pr, pw := io.Pipe()
+			f, err := startFilter(pw, "zstd", "-q", "-d", "-c")
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				_, err := io.Copy(f, r)
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				_ = pw.CloseWithError(err)
+			}()
+			return pr, nil
+		},
+		available: func() error {
+			_, err := exec.LookPath("zstd")
+			return err
+		},
+	},
+}
+
+// A filter is a command which reads its input from the filter and
+// writes its output to w.
+type filter struct {
+	io.WriteCloser // the command's stdin
+	cmd            *exec.Cmd
+	stderr         bytes.Buffer
+}
+
+// startFilter starts the named command with its output going to w.
+func startFilter(w io.Writer, name string, args ...string) (*filter, error) {
+	f := &filter{cmd: exec.Command(name, args...)}
+	f.cmd.Stdout = w
+	f.cmd.Stderr = &f.stderr
+	in, err := f.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	f.WriteCloser = in
+	if err := f.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes the input of the command and waits for it to finish.
+func (f *filter) Close() error {
+	err := f.WriteCloser.Close()
+	if werr := f.cmd.Wait(); werr != nil {
+		return fmt.Errorf("%s: %s: %s", f.cmd.Path, werr, bytes.TrimSpace(f.stderr.Bytes()))
+	}
+	return err
+}
+
+// lookupCodec returns the codec for name.
+func lookupCodec(name string) (codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		var names []string
+		for n := range codecs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return codec{}, fmt.Errorf("unsupported compression %q (supported: %s)", name, strings.Join(names, ", "))
+	}
+	if err := c.available(); err != nil {
+		return codec{}, fmt.Errorf("compression %q is not available: %s", name, err)
+	}
+	return c, nil
+}
+
+// compressedHeader begins every compressed entry, followed by the name
+// of the codec and a newline. The header makes an entry say how it is
+// to be read, so concurrent saves with different codecs cannot leave
+// it at odds with its metadata. Entries compressed before the header
+// was introduced are recognized by their metadata and the codec's
+// magic number.
+const compressedHeader = "\x00build-cache compressed "
+
+// readHeader returns the codec named by the header at the start of r,
+// which has been read past, or "" if r has no header.
+func readHeader(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(len(compressedHeader))
+	if err == io.EOF || err == bufio.ErrBufferFull || (err == nil && string(b) != compressedHeader) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(line, compressedHeader), "\n"), nil
+}
+
+// compressStore wraps a Store, recording metadata for each entry it
+// puts, compressing the entry with the named codec (if any), and
+// decompressing the entries it gets according to their metadata.
+// Sidecar and bookkeeping entries have no metadata and are never
+// compressed.
+type compressStore struct {
+	Store
+	compression string
+}
+
+func newCompressStore(s Store, compression string) (*compressStore, error) {
+	if compression != "" {
+		if _, err := lookupCodec(compression); err != nil {
+			return nil, err
+		}
+	}
+	return &compressStore{Store: s, compression: compression}, nil
+}
+
+// compressible returns true if the entry for key may be compressed.
+func compressible(key string) bool {
+	_, sidecar := entryFingerprint(key)
+	return !sidecar && !isBookkeeping(key)
+}
+
+func (s *compressStore) Put(key, src string) error {
+	return s.putEntry(key, src, entryMeta{})
+}
+
+// putEntry stores src as the entry for key, recording m, completed
+// with the details of src, as its metadata.
+func (s *compressStore) putEntry(key, src string, m entryMeta) error {
+	if !compressible(key) {
+		return s.Store.Put(key, src)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	m.Size = fi.Size()
+	if m.Checksum, err = fileChecksum(src); err != nil {
+		return err
+	}
+	m.Created = time.Now().UTC()
+	m.Host, _ = os.Hostname()
+	m.Compression = s.compression
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// The entry says how it is compressed, so the metadata, which is
+	// only descriptive, goes last.
+	if m.Compression == "" {
+		err = s.Store.Put(key, src)
+	} else {
+		err = s.putCompressed(key, src, m.Compression)
+	}
+	if err != nil {
+		return err
+	}
+	return putBytes(s.Store, metaKey(key), b)
+}
+
+// putCompressed stores src, compressed with the named codec and
+// preceded by the header naming it, as the entry for key.
+func (s *compressStore) putCompressed(key, src, compression string) error {
+	c, err := lookupCodec(compression)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "build-cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	in, err := os.Open(src)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	defer in.Close()
+	if _, err := io.WriteString(f, compressedHeader+compression+"\n"); err != nil {
+		_ = f.Close()
+		return err
+	}
+	w, err := c.compress(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		_ = w.Close()
+		_ = f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.Store.Put(key, f.Name())
+}
+
+// Get retrieves the entry for key, decompressing it if its header, or
+// for older entries its metadata, says it is compressed.
+func (s *compressStore) Get(key, dst string) error {
+	if !compressible(key) {
+		return s.Store.Get(key, dst)
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	stored := filepath.Join(tmp, key)
+	if err := s.Store.Get(key, stored); err != nil {
+		return err
+	}
+	f, err := os.Open(stored)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	compression, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+	if compression == "" {
+		m, err := readMeta(s.Store, key)
+		if err != nil {
+			return err
+		}
+		if c, ok := codecs[m.Compression]; ok {
+			if b, err := br.Peek(len(c.magic)); err == nil && bytes.Equal(b, c.magic) {
+				compression = m.Compression
+			}
+		}
+	}
+	if compression == "" {
+		_ = f.Close()
+		return os.Rename(stored, dst)
+	}
+
+	c, err := lookupCodec(compression)
+	if err != nil {
+		return err
+	}
+	r, err := c.decompress(br)
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+	defer r.Close()
+	return writeAtomic(dst, 0644, r)
+}
+
+func (s *compressStore) Delete(key string) error {
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	if !compressible(key) {
+		return nil
+	}
+	if err := s.Store.Delete(metaKey(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *compressStore) Lock(exclusive bool) (func(), error) {
+	if l, ok := s.Store.(locker); ok {
+		return l.Lock(exclusive)
+	}
+	return func() {}, nil
+}
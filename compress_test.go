@@ -0,0 +1,92 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	contents := []byte(strings.Repeat("!<arch>\npackage archive\n", 1000))
+	src := filepath.Join(tmp, "src")
+	if err := ioutil.WriteFile(src, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		key    string
+		codecs []string // the codecs of successive saves of the entry
+	}{
+		{"v2-00", []string{""}},
+		{"v2-01", []string{"gzip"}},
+		{"v2-02", []string{"zstd"}},
+		// The second save finds the entry present and only replaces
+		// its metadata.
+		{"v2-03", []string{"gzip", ""}},
+		{"v2-04", []string{"", "gzip"}},
+		{"v2-05", []string{"zstd", "gzip"}},
+	}
+	base := newChecksumStore(newDirStore(filepath.Join(tmp, "cache")))
+	for _, c := range testCases {
+		skip := false
+		for _, compression := range c.codecs {
+			s, err := newCompressStore(base, compression)
+			if err != nil {
+				if compression == "zstd" {
+					t.Logf("%s: %s", c.key, err)
+					skip = true
+					break
+				}
+				t.Fatal(err)
+			}
+			if err := s.Put(c.key, src); err != nil {
+				t.Fatalf("%s: %s", c.key, err)
+			}
+		}
+		if skip {
+			continue
+		}
+		s, _ := newCompressStore(base, "")
+		dst := filepath.Join(tmp, c.key)
+		if err := s.Get(c.key, dst); err != nil {
+			t.Fatalf("%s: %s", c.key, err)
+		}
+		got, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Errorf("%s: saved with %q, got %d bytes back, want %d", c.key, c.codecs, len(got), len(contents))
+		}
+	}
+}
+
+func TestCompressStoreUnknownCodec(t *testing.T) {
+	if _, err := newCompressStore(newDirStore(os.TempDir()), "lz4"); err == nil {
+		t.Error("newCompressStore accepted unknown compression lz4")
+	}
+}
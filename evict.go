@@ -0,0 +1,250 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bookkeepingKeys are the store entries which describe the cache
+// rather than hold package output. They are never evicted.
+var bookkeepingKeys = map[string]bool{
+	toolchainFile: true,
+	statsFile:     true,
+}
+
+// isBookkeeping returns true if key is a bookkeeping entry: one of
+// bookkeepingKeys or the history of an import path.
+func isBookkeeping(key string) bool {
+	return bookkeepingKeys[key] || strings.HasSuffix(key, historySuffix)
+}
+
+// sidecarSuffixes are the suffixes of the store entries which describe
+// the entries for a fingerprint, such as its manifest or the checksum
+// and metadata of an entry. A sidecar is evicted once no entry for its
+// fingerprint remains.
+var sidecarSuffixes = []string{".manifest", ".sha256", ".meta"}
+
+// entryFingerprint returns the fingerprint an entry belongs to and
+// whether the entry is a sidecar.
+func entryFingerprint(key string) (string, bool) {
+	sidecar := false
+	for stripped := true; stripped; {
+		stripped = false
+		for _, suffix := range sidecarSuffixes {
+			if strings.HasSuffix(key, suffix) {
+				key = strings.TrimSuffix(key, suffix)
+				sidecar, stripped = true, true
+			}
+		}
+	}
+	return strings.TrimSuffix(key, ".gocache"), sidecar
+}
+
+type entriesByAge []Entry
+
+func (e entriesByAge) Len() int {
+	return len(e)
+}
+
+func (e entriesByAge) Less(i, j int) bool {
+	return e[i].ModTime.Before(e[j].ModTime)
+}
+
+func (e entriesByAge) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+// evict removes the entries from s which were last used more than
+// olderThan ago and then removes the least recently used entries
+// until the cache is no larger than maxSize. A zero olderThan or
+// maxSize disables that form of eviction. The size of the cache counts
+// sidecars but not bookkeeping entries, which are never evicted. The
+// entries which were removed are returned.
+func evict(s Store, olderThan time.Duration, maxSize int64) ([]Entry, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(entriesByAge(entries))
+
+	// Deleting an entry also deletes its checksum and metadata. The
+	// other sidecars of a fingerprint, such as its manifest, go once
+	// no entry for it remains.
+	var size int64
+	sizes := map[string]int64{}
+	count := map[string]int{} // entries per fingerprint
+	for _, e := range entries {
+		fp, sidecar := entryFingerprint(e.Key)
+		if isBookkeeping(fp) {
+			continue
+		}
+		size += e.Size
+		sizes[e.Key] = e.Size
+		if !sidecar {
+			count[fp]++
+		}
+	}
+	// ownSidecar returns true if key is the checksum or metadata of an
+	// entry in s.
+	ownSidecar := func(key string) bool {
+		for _, suffix := range []string{".sha256", ".meta"} {
+			owner := strings.TrimSuffix(key, suffix)
+			if _, sidecar := entryFingerprint(owner); owner != key && !sidecar {
+				if _, ok := sizes[owner]; ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	shared := map[string]int64{} // bytes of the other sidecars per fingerprint
+	for _, e := range entries {
+		fp, sidecar := entryFingerprint(e.Key)
+		if sidecar && !isBookkeeping(fp) && !ownSidecar(e.Key) {
+			shared[fp] += e.Size
+		}
+	}
+
+	var cutoff time.Time
+	if olderThan > 0 {
+		cutoff = time.Now().Add(-olderThan)
+	}
+
+	var evicted []Entry
+	var sidecars []Entry
+	remaining := map[string]bool{}
+	for _, e := range entries {
+		fp, sidecar := entryFingerprint(e.Key)
+		if isBookkeeping(fp) {
+			continue
+		}
+		if sidecar {
+			sidecars = append(sidecars, e)
+			continue
+		}
+		expired := !cutoff.IsZero() && e.ModTime.Before(cutoff)
+		tooBig := maxSize > 0 && size > maxSize
+		if !expired && !tooBig {
+			remaining[fp] = true
+			continue
+		}
+		if err := s.Delete(e.Key); err != nil && !os.IsNotExist(err) {
+			return evicted, err
+		}
+		size -= e.Size + sizes[checksumKey(e.Key)] + sizes[metaKey(e.Key)]
+		if count[fp]--; count[fp] == 0 {
+			size -= shared[fp]
+		}
+		evicted = append(evicted, e)
+	}
+
+	for _, e := range sidecars {
+		if fp, _ := entryFingerprint(e.Key); remaining[fp] {
+			continue
+		}
+		if err := s.Delete(e.Key); err != nil && !os.IsNotExist(err) {
+			return evicted, err
+		}
+		evicted = append(evicted, e)
+	}
+	return evicted, nil
+}
+
+// parseAge parses a duration such as "7d", "2w" or "36h". In addition
+// to the units understood by time.ParseDuration, "d" (days) and "w"
+// (weeks) are accepted.
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil || !(n >= 0) || n*float64(unit) > math.MaxInt64 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// formatAge formats d for display in whole days, hours, minutes or
+// seconds, whichever is the largest unit d covers.
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// parseSize parses a size such as "20GB", "512M" or "1024". Units are
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := int64(1)
+	if n := len(t); n > 0 {
+		switch t[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			t = t[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || !(n >= 0) || n*float64(mult) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// formatSize formats n bytes for display.
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", f, units[i])
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"1.5d", 36 * time.Hour, true},
+		{"36h", 36 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"0", 0, true},
+		{"0d", 0, true},
+		{"", 0, false},
+		{"d", 0, false},
+		{"7", 0, false},
+		{"7y", 0, false},
+		{"-1d", 0, false},
+		{"-1h", 0, false},
+		{"NaNd", 0, false},
+		{"Infw", 0, false},
+		{"1e10w", 0, false},
+	}
+	for _, c := range testCases {
+		got, err := parseAge(c.in)
+		if ok := err == nil; ok != c.ok || got != c.want {
+			t.Errorf("parseAge(%q) = %s, %v; want %s, ok %t", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1024", 1024, true},
+		{"0", 0, true},
+		{"512M", 512 << 20, true},
+		{"20GB", 20 << 30, true},
+		{"20gb", 20 << 30, true},
+		{"1.5KiB", 1536, true},
+		{"2T", 2 << 40, true},
+		{"100B", 100, true},
+		{"", 0, false},
+		{"GB", 0, false},
+		{"20XB", 0, false},
+		{"-1G", 0, false},
+		{"NaN", 0, false},
+		{"InfG", 0, false},
+		{"1e10T", 0, false},
+	}
+	for _, c := range testCases {
+		got, err := parseSize(c.in)
+		if ok := err == nil; ok != c.ok || got != c.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, ok %t", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestEntryFingerprint(t *testing.T) {
+	testCases := []struct {
+		key     string
+		fp      string
+		sidecar bool
+	}{
+		{"v2-abcd", "v2-abcd", false},
+		{"v2-abcd.gocache", "v2-abcd", false},
+		{"v2-abcd.manifest", "v2-abcd", true},
+		{"v2-abcd.sha256", "v2-abcd", true},
+		{"v2-abcd.gocache.meta", "v2-abcd", true},
+		{"v2-abcd.gocache.sha256", "v2-abcd", true},
+		{statsFile, statsFile, false},
+	}
+	for _, c := range testCases {
+		if fp, sidecar := entryFingerprint(c.key); fp != c.fp || sidecar != c.sidecar {
+			t.Errorf("entryFingerprint(%q) = %q, %t; want %q, %t", c.key, fp, sidecar, c.fp, c.sidecar)
+		}
+	}
+}
+
+func TestEvictMaxSize(t *testing.T) {
+	testCases := []struct {
+		maxSize int64
+		want    []string // remaining entries
+	}{
+		{4 * 1233, []string{"v2-a1", "v2-a2", "v2-a3", "v2-a4"}},
+		{3699, []string{"v2-a2", "v2-a3", "v2-a4"}},
+		{3698, []string{"v2-a3", "v2-a4"}},
+		{1233, []string{"v2-a4"}},
+		{1, nil},
+	}
+	for _, c := range testCases {
+		tmp, err := ioutil.TempDir("", "build-cache-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		// Each entry takes 1233 bytes with its sidecars. The
+		// bookkeeping entries do not count toward the size.
+		files := map[string]string{
+			statsFile:                   strings.Repeat("s", 5000),
+			historyKey("example.com/a"): strings.Repeat("h", 5000),
+			"v2-b1.manifest":            strings.Repeat("o", 10),
+			"v2-b1.gocache":             strings.Repeat("g", 10),
+		}
+		for i := 1; i <= 4; i++ {
+			key := fmt.Sprintf("v2-a%d", i)
+			files[key] = strings.Repeat("e", 1000)
+			files[checksumKey(key)] = strings.Repeat("c", 64)
+			files[metaKey(key)] = strings.Repeat("m", 100)
+			files[manifestKey(key)] = strings.Repeat("f", 69)
+		}
+		dir := filepath.Join(tmp, "cache")
+		writeFiles(t, dir, files)
+		ds := newDirStore(dir)
+		// The unrelated gocache entry is the most recently used.
+		for i, key := range []string{"v2-a1", "v2-a2", "v2-a3", "v2-a4", "v2-b1.gocache"} {
+			mtime := time.Now().Add(time.Duration(i-10) * time.Hour)
+			if err := os.Chtimes(filepath.Join(dir, key), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, err := newCompressStore(newChecksumStore(ds), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := evict(s, 0, c.maxSize+20); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := 1; i <= 4; i++ {
+			key := fmt.Sprintf("v2-a%d", i)
+			ok, err := ds.Has(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				got = append(got, key)
+			}
+			for _, sidecar := range []string{checksumKey(key), metaKey(key), manifestKey(key)} {
+				if has, _ := ds.Has(sidecar); has != ok {
+					t.Errorf("max size %d: %s left = %t, but %s left = %t", c.maxSize, sidecar, has, key, ok)
+				}
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("max size %d: %q remain, want %q", c.maxSize, got, c.want)
+		}
+		for _, key := range []string{statsFile, historyKey("example.com/a")} {
+			if ok, _ := ds.Has(key); !ok {
+				t.Errorf("max size %d: bookkeeping entry %s was evicted", c.maxSize, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An inputFlag is a named group of values included in a fingerprint.
+type inputFlag struct {
+	Name   string
+	Values []string
+}
+
+// A manifest records the inputs to a package fingerprint. It is saved
+// next to each cache entry so that a later fingerprint which misses
+// the cache can be compared against it.
+type manifest struct {
+	ImportPath  string
+	Fingerprint string
+	Deps        map[string]string // import path -> fingerprint
+	Flags       []inputFlag
+	Files       map[string]string // file name -> hash of contents
+}
+
+// manifestKey returns the store key for the manifest of the package
+// with fingerprint fp.
+func manifestKey(fp string) string {
+	return fp + ".manifest"
+}
+
+// historySuffix is the suffix of the store entries which list the
+// fingerprints saved for an import path, so that explain can find the
+// manifests of a package without reading every manifest in the store.
+const historySuffix = ".history"
+
+// maxHistorySize bounds the size of the history of an import path.
+// Like the stats log it is never evicted, so its oldest fingerprints
+// are dropped once it grows past this size.
+const maxHistorySize = 16 << 10
+
+// historyKey returns the store key for the history of importPath.
+func historyKey(importPath string) string {
+	sum := sha256.Sum256([]byte(importPath))
+	return hex.EncodeToString(sum[:]) + historySuffix
+}
+
+// A historyRecord is a line of the history of an import path.
+type historyRecord struct {
+	Fingerprint string
+	Saved       time.Time
+}
+
+// saveManifest saves the manifest for pkg to s and adds its
+// fingerprint to the history of its import path.
+func saveManifest(s Store, pkg *Package) error {
+	fp := pkg.Fingerprint()
+	b, err := json.Marshal(pkg.manifest)
+	if err != nil {
+		return err
+	}
+	if err := putBytes(s, manifestKey(fp), b); err != nil {
+		return err
+	}
+	b, err = json.Marshal(historyRecord{fp, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return appendBytes(s, historyKey(pkg.ImportPath), append(b, '\n'), maxHistorySize)
+}
+
+// A manifestDiff is a single difference between two manifests.
+type manifestDiff struct {
+	kind string // "file", "flag" or "dependency"
+	name string
+	desc string
+}
+
+func (d manifestDiff) String() string {
+	return fmt.Sprintf("%s %s %s", d.kind, d.name, d.desc)
+}
+
+// diff returns the differences between m and the older manifest o.
+func (m *manifest) diff(o *manifest) []manifestDiff {
+	var diffs []manifestDiff
+	diffMaps := func(kind string, cur, old map[string]string) {
+		for name, v := range cur {
+			if ov, ok := old[name]; !ok {
+				diffs = append(diffs, manifestDiff{kind, name, "added"})
+			} else if v != ov {
+				diffs = append(diffs, manifestDiff{kind, name, fmt.Sprintf("changed (%.12s, was %.12s)", v, ov)})
+			}
+		}
+		for name := range old {
+			if _, ok := cur[name]; !ok {
+				diffs = append(diffs, manifestDiff{kind, name, "removed"})
+			}
+		}
+	}
+
+	cur := map[string]string{}
+	for _, f := range m.Flags {
+		cur[f.Name] = strings.Join(f.Values, " ")
+	}
+	old := map[string]string{}
+	for _, f := range o.Flags {
+		old[f.Name] = strings.Join(f.Values, " ")
+	}
+	for name, v := range cur {
+		if ov := old[name]; v != ov {
+			diffs = append(diffs, manifestDiff{"flag", name, fmt.Sprintf("%q, was %q", v, ov)})
+		}
+	}
+	for name, ov := range old {
+		if _, ok := cur[name]; !ok {
+			diffs = append(diffs, manifestDiff{"flag", name, fmt.Sprintf("removed, was %q", ov)})
+		}
+	}
+
+	diffMaps("file", m.Files, o.Files)
+	diffMaps("dependency", m.Deps, o.Deps)
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].kind != diffs[j].kind {
+			return diffs[i].kind > diffs[j].kind
+		}
+		return diffs[i].name < diffs[j].name
+	})
+	return diffs
+}
+
+// A cachedManifest is a manifest loaded from a store.
+type cachedManifest struct {
+	*manifest
+	saved time.Time
+}
+
+// loadManifests returns the manifests saved for pkg: the one for its
+// current fingerprint, if any, and those for the fingerprints in the
+// history of its import path. Manifests which have been evicted are
+// skipped.
+func loadManifests(s Store, pkg *Package) ([]cachedManifest, error) {
+	records := []historyRecord{{Fingerprint: pkg.Fingerprint()}}
+	b, err := getBytes(s, historyKey(pkg.ImportPath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var r historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Printf("%s: %s", historyKey(pkg.ImportPath), err)
+			continue
+		}
+		records = append(records, r)
+	}
+
+	var manifests []cachedManifest
+	seen := map[string]int{}
+	for _, r := range records {
+		if i, ok := seen[r.Fingerprint]; ok {
+			if r.Saved.After(manifests[i].saved) {
+				manifests[i].saved = r.Saved
+			}
+			continue
+		}
+		key := manifestKey(r.Fingerprint)
+		b, err := getBytes(s, key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		m := &manifest{}
+		if err := json.Unmarshal(b, m); err != nil {
+			log.Printf("%s: %s", key, err)
+			continue
+		}
+		if m.ImportPath != pkg.ImportPath {
+			continue
+		}
+		seen[r.Fingerprint] = len(manifests)
+		manifests = append(manifests, cachedManifest{m, r.Saved})
+	}
+	return manifests, nil
+}
+
+// explain reports why the fingerprints of the named packages are not
+// in the cache by comparing their inputs against the closest cached
+// manifest. Dependencies whose fingerprints changed are explained in
+// turn, leading to the inputs which actually changed.
+func explain(args []string) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	s := openCache()
+	defer lockStore(s, false)()
+	pkgs := loadAll(args, false)
+	byPath := map[string]*Package{}
+	var queue []*Package
+	for _, pkg := range pkgs {
+		byPath[pkg.ImportPath] = pkg
+		if !pkg.DepOnly {
+			queue = append(queue, pkg)
+		}
+	}
+
+	explained := map[*Package]bool{}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		if explained[pkg] {
+			continue
+		}
+		explained[pkg] = true
+
+		fp := pkg.Fingerprint()
+		hit := false
+		for _, key := range []string{fp, gocacheKey(fp)} {
+			ok, err := s.Has(key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			hit = hit || ok
+		}
+		if hit {
+			log.Printf("%s: %s is in the cache", pkg.ImportPath, fp)
+			continue
+		}
+
+		manifests, err := loadManifests(s, pkg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var closest *cachedManifest
+		var closestDiffs []manifestDiff
+		for i := range manifests {
+			c := &manifests[i]
+			diffs := pkg.manifest.diff(c.manifest)
+			if closest == nil || len(diffs) < len(closestDiffs) ||
+				(len(diffs) == len(closestDiffs) && c.saved.After(closest.saved)) {
+				closest, closestDiffs = c, diffs
+			}
+		}
+		if closest == nil {
+			log.Printf("%s: %s is not in the cache and nothing was ever saved for it", pkg.ImportPath, fp)
+			continue
+		}
+
+		saved := "saved at an unknown time"
+		if !closest.saved.IsZero() {
+			saved = "saved " + closest.saved.Format(time.RFC3339)
+		}
+		log.Printf("%s: %s is not in the cache; closest is %s, %s",
+			pkg.ImportPath, fp, closest.Fingerprint, saved)
+		for _, d := range closestDiffs {
+			log.Printf("  %s", d)
+			if d.kind == "dependency" {
+				if dep := byPath[d.name]; dep != nil {
+					queue = append(queue, dep)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoadManifests(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	s := newDirStore(tmp)
+
+	pkg := func(importPath, fp string) *Package {
+		return &Package{
+			Package:     &build.Package{ImportPath: importPath},
+			fingerprint: &fp,
+			manifest:    &manifest{ImportPath: importPath, Fingerprint: fp},
+		}
+	}
+	for _, p := range []*Package{
+		pkg("example.com/a", "v2-aaaa01"),
+		pkg("example.com/b", "v2-bbbb01"),
+		pkg("example.com/a", "v2-aaaa02"),
+		pkg("example.com/a", "v2-aaaa01"),
+	} {
+		if err := saveManifest(s, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A manifest missing from the history of its import path is only
+	// found by its own fingerprint.
+	if err := putBytes(s, manifestKey("v2-aaaa03"), []byte(`{"ImportPath":"example.com/a","Fingerprint":"v2-aaaa03"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(manifestKey("v2-aaaa02")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		pkg  *Package
+		want []string
+	}{
+		{pkg("example.com/a", "v2-aaaa04"), []string{"v2-aaaa01"}},
+		{pkg("example.com/a", "v2-aaaa03"), []string{"v2-aaaa03", "v2-aaaa01"}},
+		{pkg("example.com/b", "v2-bbbb02"), []string{"v2-bbbb01"}},
+		{pkg("example.com/c", "v2-aaaa01"), nil},
+	}
+	for _, c := range testCases {
+		manifests, err := loadManifests(s, c.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range manifests {
+			got = append(got, m.Fingerprint)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("loadManifests(%s %s) = %q, want %q", c.pkg.ImportPath, c.pkg.Fingerprint(), got, c.want)
+		}
+	}
+
+	// The history outlives the entries it lists.
+	if _, err := evict(s, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Has(historyKey("example.com/a")); err != nil || !ok {
+		t.Errorf("history of example.com/a was evicted: %v", err)
+	}
+}
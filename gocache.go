@@ -0,0 +1,338 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The go command's build cache (GOCACHE) holds two kinds of files in
+// subdirectories named by the first two hex digits of their ID:
+// action entries ("<id>-a"), which map an action ID to an output ID,
+// and outputs ("<id>-d"). The compiled package reported by "go list
+// -export" is an output. In GOCACHE mode, save bundles that output and
+// the action entries which refer to it into a single tar file stored
+// under gocacheKey of the package fingerprint, and restore unpacks
+// the bundle back into GOCACHE.
+
+// gocacheKey returns the store key for the GOCACHE entries of the
+// package with fingerprint fp.
+func gocacheKey(fp string) string {
+	return fp + ".gocache"
+}
+
+// groupByOptions groups package arguments by their build options,
+// preserving the order in which each option set first appears. The
+// patterns are keyed by the canonical form of the options.
+func groupByOptions(args []string) ([]buildOptions, map[string][]string) {
+	var optionSets []buildOptions
+	patterns := map[string][]string{}
+	for _, arg := range args {
+		opts := packageBuildOptions(arg)
+		if _, ok := patterns[opts.String()]; !ok {
+			optionSets = append(optionSets, opts)
+		}
+		patterns[opts.String()] = append(patterns[opts.String()], packageBaseImportPath(arg))
+	}
+	return optionSets, patterns
+}
+
+// exportFiles returns the GOCACHE output holding the compiled form of
+// each of the packages named by args and their dependencies, and those
+// of their tests if tests is set, keyed by import path. Building the
+// packages first is what populates GOCACHE; "go list -export" builds
+// anything that is missing.
+func exportFiles(args []string, tests bool) map[string]string {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	exports := map[string]string{}
+	optionSets, patterns := groupByOptions(args)
+	for _, opts := range optionSets {
+		listArgs := []string{"list", "-e", "-deps", "-export", "-f", "{{.ImportPath}}\t{{.Export}}"}
+		if tests {
+			listArgs = append(listArgs, "-test")
+		}
+		listArgs = append(listArgs, opts.goFlags()...)
+		listArgs = append(listArgs, patterns[opts.String()]...)
+
+		cmd := exec.Command("go", listArgs...)
+		cmd.Env = append(os.Environ(), opts.goEnv()...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			log.Fatalf("go %s: %s\n%s", strings.Join(listArgs[1:], " "), err, stderr.Bytes())
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.SplitN(line, "\t", 2)
+			if len(fields) != 2 || fields[1] == "" || isTestVariant(fields[0]) {
+				continue
+			}
+			exports[opts.importPath(fields[0])] = fields[1]
+		}
+	}
+	return exports
+}
+
+// hasGocacheOutput returns false for the packages which the go command
+// never compiles and so have no GOCACHE output: unsafe is built into
+// the compiler.
+func hasGocacheOutput(pkg *Package) bool {
+	return !pkg.Standard || pkg.baseImportPath != "unsafe"
+}
+
+// A gocacheIndex maps GOCACHE output IDs to the action entries which
+// refer to them.
+type gocacheIndex map[string][]string
+
+// indexGocache scans the action entries in dir.
+func indexGocache(dir string) (gocacheIndex, error) {
+	index := gocacheIndex{}
+	subdirs, err := filepath.Glob(filepath.Join(dir, "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subdirs {
+		names, err := filepath.Glob(filepath.Join(sub, "*-a"))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			b, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			// An action entry is "v1 <action ID> <output ID> <size> <time>".
+			fields := strings.Fields(string(b))
+			if len(fields) != 5 || fields[0] != "v1" {
+				continue
+			}
+			index[fields[2]] = append(index[fields[2]], name)
+		}
+	}
+	return index, nil
+}
+
+// files returns the files in GOCACHE which make up the cached
+// build of the package whose compiled output is export.
+func (index gocacheIndex) files(export string) []string {
+	outputID := strings.TrimSuffix(filepath.Base(export), "-d")
+	return append([]string{export}, index[outputID]...)
+}
+
+// writeGocacheBundle writes files, which are relative to dir, to a tar
+// file at path.
+func writeGocacheBundle(path, dir string, files []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readGocacheBundle unpacks the tar file at path into dir. Files which
+// already exist are left alone; everything unpacked is marked as used
+// now so the go command does not trim it.
+func readGocacheBundle(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now()
+	tr := tar.NewReader(bufio.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return fmt.Errorf("%s: invalid GOCACHE file %q", path, hdr.Name)
+		}
+		dst := filepath.Join(dir, name)
+		if !exists(dst) {
+			if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+				return err
+			}
+			if err := writeAtomic(dst, 0666, tr); err != nil {
+				return err
+			}
+		}
+		if err := os.Chtimes(dst, now, now); err != nil {
+			return err
+		}
+	}
+}
+
+// saveGocache saves the GOCACHE entries for pkgs, which were loaded
+// from args (with the dependencies of their tests if tests is set), to
+// s.
+func saveGocache(s Store, args []string, tests bool, pkgs []*Package, j int, rep *reporter) {
+	dir := goToolchain().GOCACHE
+	if dir == "" || dir == "off" {
+		log.Fatal("GOCACHE is not enabled")
+	}
+	exports := exportFiles(args, tests)
+	index, err := indexGocache(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "build-cache")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	start := time.Now()
+	fingerprintAll(pkgs, j)
+	log.Printf("finished fingerprinting: %s", time.Since(start))
+
+	parallel(len(pkgs), j, func(i int) {
+		pkg := pkgs[i]
+		start := time.Now()
+		export := exports[pkg.ImportPath]
+		r := packageRecord{ImportPath: pkg.ImportPath, Target: export}
+		if export == "" || !exists(export) {
+			r.Action, r.Reason = actionSkipped, "no export data"
+			rep.record(r, start)
+			return
+		}
+		r.Fingerprint = pkg.Fingerprint()
+		key := gocacheKey(r.Fingerprint)
+		ok, err := s.Has(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ok {
+			r.Action = actionCached
+		} else {
+			bundle := filepath.Join(tmp, key)
+			if err := writeGocacheBundle(bundle, dir, index.files(export)); err != nil {
+				log.Fatal(err)
+			}
+			// The bundle is unpacked into GOCACHE rather than the
+			// package's target.
+			m := packageMeta(pkg)
+			m.Target = ""
+			if err := putEntry(s, key, bundle, m); err != nil {
+				log.Fatal(err)
+			}
+			if err := saveManifest(s, pkg); err != nil {
+				log.Fatal(err)
+			}
+			r.Action = actionSaved
+			r.Bytes = fileSize(bundle)
+			_ = os.Remove(bundle)
+		}
+		rep.record(r, start)
+	})
+}
+
+// restoreGocache restores the GOCACHE entries for pkgs from s.
+func restoreGocache(s Store, pkgs []*Package, j int, rep *reporter) {
+	dir := goToolchain().GOCACHE
+	if dir == "" || dir == "off" {
+		log.Fatal("GOCACHE is not enabled")
+	}
+
+	tmp, err := ioutil.TempDir("", "build-cache")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	start := time.Now()
+	fingerprintAll(pkgs, j)
+	log.Printf("finished fingerprinting: %s", time.Since(start))
+
+	parallel(len(pkgs), j, func(i int) {
+		pkg := pkgs[i]
+		start := time.Now()
+		r := packageRecord{ImportPath: pkg.ImportPath}
+		if !hasGocacheOutput(pkg) {
+			r.Action, r.Reason = actionSkipped, "no export data"
+			rep.record(r, start)
+			return
+		}
+		r.Fingerprint = pkg.Fingerprint()
+		key := gocacheKey(r.Fingerprint)
+		bundle := filepath.Join(tmp, key)
+		if err := s.Get(key, bundle); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			r.Action = actionMissed
+			rep.record(r, start)
+			return
+		}
+		if err := readGocacheBundle(bundle, dir); err != nil {
+			log.Fatal(err)
+		}
+		r.Action = actionRestored
+		r.Bytes = fileSize(bundle)
+		_ = os.Remove(bundle)
+		rep.record(r, start)
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestGocacheBundle checks that a bundle unpacks to the files it was
+// made from, leaving files which already exist alone.
+func TestGocacheBundle(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	files := map[string]string{
+		"ab/abcd-a": "action",
+		"cd/cdef-d": "output",
+	}
+	writeFiles(t, src, files)
+	var paths []string
+	for name := range files {
+		paths = append(paths, filepath.Join(src, filepath.FromSlash(name)))
+	}
+	bundle := filepath.Join(tmp, "bundle.tar")
+	if err := writeGocacheBundle(bundle, src, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	writeFiles(t, dst, map[string]string{"ab/abcd-a": "existing"})
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	existing := filepath.Join(dst, "ab", "abcd-a")
+	if err := os.Chtimes(existing, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := readGocacheBundle(bundle, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name, want string
+	}{
+		{"ab/abcd-a", "existing"},
+		{"cd/cdef-d", "output"},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(dst, filepath.FromSlash(tc.name))
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if string(b) != tc.want {
+			t.Errorf("%s = %q, want %q", tc.name, b, tc.want)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().After(old) {
+			t.Errorf("%s was not marked as used", tc.name)
+		}
+	}
+}
+
+// TestGocacheBundleInvalid checks that a bundle cannot write outside
+// the GOCACHE directory.
+func TestGocacheBundleInvalid(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "gocache")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []string{
+		"../escaped",
+		"ab/../../escaped",
+		filepath.ToSlash(filepath.Join(tmp, "escaped")),
+	}
+	for _, name := range testCases {
+		bundle := filepath.Join(tmp, "bundle.tar")
+		f, err := os.Create(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(f)
+		body := "escaped"
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if err := readGocacheBundle(bundle, dir); err == nil {
+			t.Errorf("%q: unpacked without error", name)
+		}
+		if exists(filepath.Join(tmp, "escaped")) {
+			t.Errorf("%q: written outside %s", name, dir)
+			os.Remove(filepath.Join(tmp, "escaped"))
+		}
+	}
+}
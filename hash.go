@@ -0,0 +1,107 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"regexp"
+	"runtime"
+)
+
+// A fingerprintScheme determines how package fingerprints are computed
+// and how they are written. Every fingerprint begins with the version
+// of its scheme, which is also the first thing hashed, so changing what
+// goes into a fingerprint only requires a new version to keep new
+// fingerprints from colliding with the entries of old ones.
+type fingerprintScheme struct {
+	version string // prefix of every fingerprint; empty for legacy SHA1
+	size    int    // size of the digest in bytes
+	newHash func() hash.Hash
+}
+
+// fingerprintSchemes maps the values of the -hash flag to the schemes
+// they select. "sha1" reproduces the unversioned fingerprints of caches
+// saved before the switch to SHA-256.
+var fingerprintSchemes = map[string]*fingerprintScheme{
+	"sha256": {version: "v2", size: sha256.Size, newHash: sha256.New},
+	"sha1":   {size: sha1.Size, newHash: sha1.New},
+}
+
+// scheme is the fingerprint scheme in use.
+var scheme = fingerprintSchemes["sha256"]
+
+// setFingerprintScheme selects the fingerprint scheme named by the
+// -hash flag.
+func setFingerprintScheme(name string) error {
+	s, ok := fingerprintSchemes[name]
+	if !ok {
+		return fmt.Errorf("unknown hash %q", name)
+	}
+	scheme = s
+	return nil
+}
+
+// legacyToolchainFlags returns the toolchain inputs of legacy
+// fingerprints: the version and platform build-cache itself was
+// compiled with.
+func legacyToolchainFlags() []inputFlag {
+	return []inputFlag{
+		{"build-cache go version", []string{runtime.Version()}},
+		{"build-cache GOOS", []string{runtime.GOOS}},
+		{"build-cache GOARCH", []string{runtime.GOARCH}},
+	}
+}
+
+// newFingerprintHash returns the hash for fingerprints, primed with
+// the version of the scheme.
+func (s *fingerprintScheme) newFingerprintHash() hash.Hash {
+	h := s.newHash()
+	if s.version != "" {
+		_, _ = h.Write([]byte("build-cache fingerprint " + s.version))
+	}
+	return h
+}
+
+// format returns the fingerprint for digest.
+func (s *fingerprintScheme) format(digest []byte) string {
+	if s.version == "" {
+		return fmt.Sprintf("%x", digest)
+	}
+	return fmt.Sprintf("%s-%x", s.version, digest)
+}
+
+// width returns the length of a fingerprint.
+func (s *fingerprintScheme) width() int {
+	if s.version == "" {
+		return 2 * s.size
+	}
+	return len(s.version) + 1 + 2*s.size
+}
+
+// versionPrefix matches the version at the beginning of a fingerprint.
+var versionPrefix = regexp.MustCompile(`^v[0-9]+-`)
+
+// trimVersion returns key without the fingerprint version it begins
+// with, if any.
+func trimVersion(key string) string {
+	if loc := versionPrefix.FindStringIndex(key); loc != nil {
+		return key[loc[1]:]
+	}
+	return key
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestLegacyFingerprint checks that -hash=sha1 reproduces the
+// fingerprints of caches saved before fingerprints were versioned.
+func TestLegacyFingerprint(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := "package x\n"
+	if err := ioutil.WriteFile(filepath.Join(tmp, "x.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := scheme
+	defer func() { scheme = old }()
+	if err := setFingerprintScheme("sha1"); err != nil {
+		t.Fatal(err)
+	}
+	p := &Package{Package: &build.Package{
+		ImportPath: "example.com/x",
+		Dir:        tmp,
+		GoFiles:    []string{"x.go"},
+		CgoCFLAGS:  []string{"-O2"},
+	}}
+
+	// The inputs, in order, of the fingerprints of old caches.
+	h := sha1.New()
+	for _, s := range []string{runtime.Version(), runtime.GOOS, runtime.GOARCH, "example.com/x", "-O2", "x.go", src} {
+		h.Write([]byte(s))
+	}
+	if got, want := p.Fingerprint(), hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("legacy fingerprint = %s, want %s", got, want)
+	}
+}
+
+func TestTrimVersion(t *testing.T) {
+	testCases := []struct {
+		key, want string
+	}{
+		{"v2-abcd", "abcd"},
+		{"v10-abcd.meta", "abcd.meta"},
+		{"abcd", "abcd"},
+		{"v-abcd", "v-abcd"},
+		{"stats.jsonl", "stats.jsonl"},
+	}
+	for _, c := range testCases {
+		if got := trimVersion(c.key); got != c.want {
+			t.Errorf("trimVersion(%q) = %q, want %q", c.key, got, c.want)
+		}
+	}
+}
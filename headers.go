@@ -0,0 +1,186 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A cgo package can include headers from outside its directory, found
+// through the -I paths of its cgo flags or relative to the including
+// file. Those headers are not among the package's HFiles, so they are
+// found by following the #include directives of the package's sources
+// and added to its fingerprint. System headers, which are not found in
+// the package directory or its -I paths, are left out; they change with
+// the toolchain rather than the sources.
+
+// includeDirective matches an #include (or #import) directive in C
+// source or in the preamble of a cgo file, where it follows "//".
+// Includes naming a macro are not followed.
+var includeDirective = regexp.MustCompile(`^\s*(?://)?\s*#\s*(?:include|include_next|import)\s*([<"])([^>"]+)[>"]`)
+
+// An include is an #include directive.
+type include struct {
+	name   string
+	quoted bool // "name" rather than <name>
+}
+
+// includeCache memoizes the includes of each file scanned. Packages
+// are fingerprinted concurrently and often share headers.
+var includeCache struct {
+	sync.Mutex
+	m map[string][]include
+}
+
+// scanIncludes returns the include directives of the file at path.
+func scanIncludes(path string) ([]include, error) {
+	includeCache.Lock()
+	incs, ok := includeCache.m[path]
+	includeCache.Unlock()
+	if ok {
+		return incs, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "#") {
+			continue
+		}
+		if m := includeDirective.FindStringSubmatch(line); m != nil {
+			incs = append(incs, include{name: m[2], quoted: m[1] == `"`})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	includeCache.Lock()
+	if includeCache.m == nil {
+		includeCache.m = map[string][]include{}
+	}
+	includeCache.m[path] = incs
+	includeCache.Unlock()
+	return incs, nil
+}
+
+// includeDirs returns the directories named by the -I, -iquote and
+// -isystem options in flags. Relative directories are relative to dir.
+func includeDirs(dir string, flags ...[]string) []string {
+	var dirs []string
+	add := func(d string) {
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(dir, d)
+		}
+		dirs = append(dirs, filepath.Clean(d))
+	}
+	for _, list := range flags {
+		for i := 0; i < len(list); i++ {
+			for _, opt := range []string{"-I", "-iquote", "-isystem"} {
+				if list[i] == opt && i+1 < len(list) {
+					i++
+					add(list[i])
+					break
+				}
+				if strings.HasPrefix(list[i], opt) && len(list[i]) > len(opt) {
+					add(list[i][len(opt):])
+					break
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// includedHeaders returns the headers, other than its own HFiles,
+// which the C, C++, assembly and cgo sources of p include directly or
+// indirectly. The headers are named relative to the package directory
+// where possible and are sorted.
+func (p *Package) includedHeaders() []string {
+	sources := stringList(p.CgoFiles, p.CFiles, p.CXXFiles, p.MFiles, p.HFiles, p.SFiles, p.SwigFiles, p.SwigCXXFiles)
+	if len(sources) == 0 {
+		return nil
+	}
+	dirs := includeDirs(p.Dir, p.CgoCFLAGS, p.CgoCPPFLAGS, p.CgoCXXFLAGS)
+
+	own := map[string]bool{}
+	for _, file := range p.HFiles {
+		own[filepath.Join(p.Dir, file)] = true
+	}
+	seen := map[string]bool{}
+	var headers []string
+	var scan func(path string)
+	scan = func(path string) {
+		incs, err := scanIncludes(path)
+		if err != nil {
+			// Unreadable files are reported by Fingerprint if they
+			// are sources, and cannot be hashed if they are headers.
+			return
+		}
+		for _, inc := range incs {
+			var candidates []string
+			switch {
+			case filepath.IsAbs(inc.name):
+				candidates = append(candidates, filepath.Clean(inc.name))
+			case inc.quoted:
+				candidates = append(candidates, filepath.Join(filepath.Dir(path), inc.name))
+				fallthrough
+			default:
+				for _, dir := range dirs {
+					candidates = append(candidates, filepath.Join(dir, inc.name))
+				}
+			}
+			for _, header := range candidates {
+				if fi, err := os.Stat(header); err != nil || fi.IsDir() {
+					continue
+				}
+				if !seen[header] {
+					seen[header] = true
+					if !own[header] {
+						headers = append(headers, header)
+					}
+					scan(header)
+				}
+				break
+			}
+		}
+	}
+	for _, file := range sources {
+		path := filepath.Join(p.Dir, file)
+		seen[path] = true
+		scan(path)
+	}
+
+	for i, header := range headers {
+		if rel, err := filepath.Rel(p.Dir, header); err == nil {
+			headers[i] = rel
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
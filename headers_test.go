@@ -0,0 +1,129 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncludeDirective(t *testing.T) {
+	testCases := []struct {
+		line   string
+		name   string // empty if the line is not an include
+		quoted bool
+	}{
+		{`#include "foo.h"`, "foo.h", true},
+		{`#include <stdio.h>`, "stdio.h", false},
+		{`#include<sys/types.h>`, "sys/types.h", false},
+		{`  #  include "a/b.h"  // comment`, "a/b.h", true},
+		{`// #include "cgo.h"`, "cgo.h", true},
+		{`//#include <zlib.h>`, "zlib.h", false},
+		{`#include_next <limits.h>`, "limits.h", false},
+		{`#import "objc.h"`, "objc.h", true},
+		{`#include FOO_H`, "", false},
+		{`#define X "foo.h"`, "", false},
+		{`#includes "foo.h"`, "", false},
+		{`x = 1; // #include "foo.h"`, "", false},
+		{`#include ""`, "", false},
+	}
+	for _, c := range testCases {
+		m := includeDirective.FindStringSubmatch(c.line)
+		if c.name == "" {
+			if m != nil {
+				t.Errorf("%q matched as an include of %q", c.line, m[2])
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%q did not match", c.line)
+			continue
+		}
+		if m[2] != c.name || (m[1] == `"`) != c.quoted {
+			t.Errorf("%q: include of %q (quoted %t), want %q (quoted %t)", c.line, m[2], m[1] == `"`, c.name, c.quoted)
+		}
+	}
+}
+
+func TestIncludeDirs(t *testing.T) {
+	testCases := []struct {
+		flags [][]string
+		want  []string
+	}{
+		{nil, nil},
+		{[][]string{{"-O2", "-Wall"}}, nil},
+		{[][]string{{"-Iinc", "-I", "../other"}}, []string{"/pkg/inc", "/other"}},
+		{[][]string{{"-I/abs/inc"}, {"-iquote", "q", "-isystem/sys"}}, []string{"/abs/inc", "/pkg/q", "/sys"}},
+		{[][]string{{"-I"}}, nil},
+		{[][]string{{"-include", "x.h"}}, nil},
+	}
+	for _, c := range testCases {
+		got := includeDirs("/pkg", c.flags...)
+		var want []string
+		for _, d := range c.want {
+			want = append(want, filepath.FromSlash(d))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("includeDirs(%q) = %q, want %q", c.flags, got, want)
+		}
+	}
+}
+
+func TestIncludedHeaders(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFiles(t, tmp, map[string]string{
+		"pkg/p.go":          "package p\n\n// #include \"own.h\"\n// #include <inc.h>\n// #include <stdio.h>\nimport \"C\"\n",
+		"pkg/own.h":         "#include \"../shared/shared.h\"\n",
+		"pkg/c.c":           "#include \"sub/local.h\"\n#include \"" + filepath.ToSlash(filepath.Join(tmp, "abs.h")) + "\"\n",
+		"pkg/sub/local.h":   "#include \"sibling.h\"\n",
+		"pkg/sub/sibling.h": "#include <inc.h>\n",
+		"inc/inc.h":         "#include \"nested/n.h\"\n",
+		"inc/nested/n.h":    "",
+		"shared/shared.h":   "",
+		"abs.h":             "",
+	})
+	p := &Package{Package: &build.Package{
+		Dir:       filepath.Join(tmp, "pkg"),
+		CgoFiles:  []string{"p.go"},
+		CFiles:    []string{"c.c"},
+		HFiles:    []string{"own.h"},
+		CgoCFLAGS: []string{"-I../inc"},
+	}}
+	want := []string{
+		"../abs.h",
+		"../inc/inc.h",
+		"../inc/nested/n.h",
+		"../shared/shared.h",
+		"sub/local.h",
+		"sub/sibling.h",
+	}
+	for i := range want {
+		want[i] = filepath.FromSlash(want[i])
+	}
+	if got := p.includedHeaders(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("includedHeaders() = %q, want %q", got, want)
+	}
+}
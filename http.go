@@ -0,0 +1,387 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The HTTP protocol is a thin layer over Store: HEAD, GET, PUT and
+// DELETE on /<key> operate on a single entry, and GET on / returns
+// the JSON encoded list of entries. A GET counts as a use of the entry
+// unless the query is noTouchQuery. A server started with a token only
+// accepts PUT and DELETE requests which carry it as a bearer token.
+
+// noTouchQuery is the query of a GET which reads an entry without
+// counting it as a use. Servers which predate it ignore it.
+const noTouchQuery = "touch=0"
+
+// cacheTokenEnv is the environment variable holding the token which
+// authorizes writes to a cache server, for both the server and its
+// clients.
+const cacheTokenEnv = "CACHE_TOKEN"
+
+// httpTimeout bounds a whole request to a cache server, including the
+// transfer of the entry, so that a hung server cannot stall a build
+// indefinitely, nor a hung client the server.
+const httpTimeout = 10 * time.Minute
+
+// httpStore is a Store backed by a remote cache server, such as one
+// started with "build-cache serve".
+type httpStore struct {
+	base   *url.URL
+	client *http.Client
+	token  string // sent with every request, if set
+}
+
+func newHTTPStore(u *url.URL) (Store, error) {
+	base := *u
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return &httpStore{
+		base:   &base,
+		client: &http.Client{Timeout: httpTimeout},
+		token:  os.Getenv(cacheTokenEnv),
+	}, nil
+}
+
+func (s *httpStore) url(key string) string {
+	u := *s.base
+	u.Path += "/" + key
+	return u.String()
+}
+
+func (s *httpStore) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	return s.doURL(method, s.url(key), body, size)
+}
+
+func (s *httpStore) doURL(method, u string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: u, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *httpStore) Has(key string) (bool, error) {
+	resp, err := s.do("HEAD", key, nil, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *httpStore) Get(key, dst string) error {
+	resp, err := s.do("GET", key, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return writeAtomic(dst, 0644, resp.Body)
+}
+
+// Open reads the entry for key straight from the response, without
+// the server counting it as a use.
+func (s *httpStore) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.doURL("GET", s.url(key)+"?"+noTouchQuery, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *httpStore) Put(key, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", key, f, fi.Size())
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *httpStore) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *httpStore) List() ([]Entry, error) {
+	resp, err := s.do("GET", "", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var entries []Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *httpStore) Stat(key string) (Entry, error) {
+	resp, err := s.do("HEAD", key, nil, 0)
+	if err != nil {
+		return Entry{}, err
+	}
+	resp.Body.Close()
+	e := Entry{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		e.ModTime = t
+	}
+	return e, nil
+}
+
+func (s *httpStore) String() string {
+	return s.base.String()
+}
+
+// validKey returns true if key names an entry directly within a
+// store, guarding the server against paths which escape the cache
+// directory.
+func validKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, ".") && !strings.ContainsAny(key, "/\\")
+}
+
+// cacheHandler serves a local cache directory using the protocol
+// understood by httpStore.
+type cacheHandler struct {
+	store *dirStore
+	token string // required for writes, if set
+}
+
+func newCacheHandler(s *dirStore, token string) http.Handler {
+	return &cacheHandler{store: s, token: token}
+}
+
+// authorized returns true if r may modify the cache.
+func (h *cacheHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(h.token)) == 1
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Hold a shared lock on the directory for each request so local
+	// processes clearing the cache wait for requests in progress.
+	unlock, err := h.store.Lock(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w)
+		return
+	}
+	if !validKey(key) {
+		http.Error(w, fmt.Sprintf("invalid key %q", key), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if r.Method == "GET" && r.URL.RawQuery != noTouchQuery {
+			if err := h.store.touch(key); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		f, err := os.Open(h.store.find(key))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, fi.ModTime(), f)
+	case "PUT", "DELETE":
+		if !h.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "PUT" {
+			h.put(w, r, key)
+			return
+		}
+		if err := h.store.Delete(key); err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *cacheHandler) list(w http.ResponseWriter) {
+	entries, err := h.store.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+func (h *cacheHandler) put(w http.ResponseWriter, r *http.Request, key string) {
+	if err := h.store.mkdirFor(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	unlock, err := h.store.lockEntry(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	// Entries are immutable apart from the bookkeeping ones such as
+	// the toolchain record, so replacing is always safe.
+	if err := writeAtomic(h.store.path(key), 0644, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// logRequests wraps h, logging each request.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		log.Printf("%s %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, time.Since(start))
+	})
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	_ = flags.Parse(args)
+	token := os.Getenv(cacheTokenEnv)
+
+	dir := cacheLocation()
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+	s, err := openStore(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ds, ok := s.(*dirStore)
+	if !ok {
+		log.Fatalf("%s is not a local cache directory", s)
+	}
+
+	if token == "" && !loopback(*addr) {
+		log.Printf("warning: %s is not set, so anyone who can reach %s can replace entries", cacheTokenEnv, *addr)
+	}
+	log.Printf("serving %s on %s", ds, *addr)
+	log.Fatal(newCacheServer(*addr, logRequests(newCacheHandler(ds, token))).ListenAndServe())
+}
+
+// newCacheServer returns a server for h on addr. Each request holds a
+// shared lock on the cache directory, so the server times out requests
+// as clients do, to keep a stalled client from blocking clear, verify
+// and migrate indefinitely.
+func newCacheServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Minute,
+		ReadTimeout:       httpTimeout,
+		WriteTimeout:      httpTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// loopback returns true if the listen address addr only accepts
+// connections from the local machine.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,331 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a cache server for a new directory and returns
+// a store talking to it with the given token.
+func newTestServer(t *testing.T, serverToken, clientToken string) (*httpStore, *httptest.Server, string) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newCacheHandler(newDirStore(filepath.Join(tmp, "cache")), serverToken))
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(cacheTokenEnv, clientToken)
+	s, err := newHTTPStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*httpStore), srv, tmp
+}
+
+func TestHTTPStore(t *testing.T) {
+	s, srv, tmp := newTestServer(t, "", "")
+	defer srv.Close()
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	if err := ioutil.WriteFile(src, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const key = "v2-abcd"
+
+	if ok, err := s.Has(key); err != nil || ok {
+		t.Fatalf("Has before Put = %v, %v; want false", ok, err)
+	}
+	if err := s.Get(key, filepath.Join(tmp, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("Get of a missing entry: %v; want not exist", err)
+	}
+	if err := s.Put(key, src); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Has(key); err != nil || !ok {
+		t.Fatalf("Has after Put = %v, %v; want true", ok, err)
+	}
+	dst := filepath.Join(tmp, "dst")
+	if err := s.Get(key, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "archive" {
+		t.Fatalf("Get = %q, %v; want \"archive\"", b, err)
+	}
+	if e, err := s.Stat(key); err != nil || e.Size != int64(len("archive")) {
+		t.Fatalf("Stat = %+v, %v", e, err)
+	}
+	if entries, err := s.List(); err != nil || len(entries) != 1 || entries[0].Key != key {
+		t.Fatalf("List = %+v, %v", entries, err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(key); !os.IsNotExist(err) {
+		t.Fatalf("Delete of a missing entry: %v; want not exist", err)
+	}
+	if ok, err := s.Has(key); err != nil || ok {
+		t.Fatalf("Has after Delete = %v, %v; want false", ok, err)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	_, srv, tmp := newTestServer(t, "secret", "")
+	defer srv.Close()
+	defer os.RemoveAll(tmp)
+
+	testCases := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/", "", http.StatusOK},
+		{"POST", "/", "", http.StatusMethodNotAllowed},
+		{"GET", "/v2-abcd", "", http.StatusNotFound},
+		{"GET", "/.lock", "", http.StatusBadRequest},
+		{"GET", "/ab/v2-abcd", "", http.StatusBadRequest},
+		{"PATCH", "/v2-abcd", "secret", http.StatusMethodNotAllowed},
+		{"PUT", "/v2-abcd", "", http.StatusUnauthorized},
+		{"PUT", "/v2-abcd", "wrong", http.StatusUnauthorized},
+		{"DELETE", "/v2-abcd", "", http.StatusUnauthorized},
+		{"PUT", "/v2-abcd", "secret", http.StatusCreated},
+		{"HEAD", "/v2-abcd", "", http.StatusOK},
+		{"DELETE", "/v2-abcd", "secret", http.StatusNoContent},
+		{"DELETE", "/v2-abcd", "secret", http.StatusNotFound},
+	}
+	for _, c := range testCases {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader("archive"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s %s (token %q): %s, want %d", c.method, c.path, c.token, resp.Status, c.want)
+		}
+	}
+}
+
+func TestHTTPStoreToken(t *testing.T) {
+	s, srv, tmp := newTestServer(t, "secret", "secret")
+	defer srv.Close()
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	if err := ioutil.WriteFile(src, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("v2-abcd", src); err != nil {
+		t.Fatal(err)
+	}
+	s.token = ""
+	if err := s.Put("v2-abcd", src); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Put without the token: %v; want 401", err)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	testCases := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"cache-host:8080", false},
+		{"8080", false},
+	}
+	for _, c := range testCases {
+		if got := loopback(c.addr); got != c.want {
+			t.Errorf("loopback(%q) = %v, want %v", c.addr, got, c.want)
+		}
+	}
+}
+
+// TestHTTPStoreOpen checks that reading an entry in place, as status
+// does with the toolchain, does not count as a use of it while Get
+// does.
+func TestHTTPStoreOpen(t *testing.T) {
+	s, srv, tmp := newTestServer(t, "", "")
+	defer srv.Close()
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "cache", toolchainFile)
+	writeFiles(t, filepath.Join(tmp, "cache"), map[string]string{toolchainFile: `{"Version":"go1.0"}`})
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []Store{s, newDirStore(filepath.Join(tmp, "cache"))} {
+		b, err := readBytes(store, toolchainFile)
+		if err != nil || string(b) != `{"Version":"go1.0"}` {
+			t.Fatalf("%s: readBytes = %q, %v", store, b, err)
+		}
+		if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(old) {
+			t.Fatalf("%s: reading in place touched the entry: %v", store, err)
+		}
+	}
+	if _, err := getBytes(s, toolchainFile); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.ModTime().Equal(old) {
+		t.Errorf("Get did not touch the entry: %v", err)
+	}
+}
+
+// TestHTTPStoreCorruptReadOnly checks that a client which may not
+// quarantine a corrupt entry still reports it as a miss.
+func TestHTTPStoreCorruptReadOnly(t *testing.T) {
+	s, srv, tmp := newTestServer(t, "secret", "")
+	defer srv.Close()
+	defer os.RemoveAll(tmp)
+
+	writeFiles(t, filepath.Join(tmp, "cache"), map[string]string{
+		"ab/v2-abcd":        "corrupt",
+		"ab/v2-abcd.sha256": "0000",
+	})
+	err := newChecksumStore(s).Get("v2-abcd", filepath.Join(tmp, "dst"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Get of a corrupt entry: %v; want not exist", err)
+	}
+	if exists(filepath.Join(tmp, "dst")) {
+		t.Errorf("corrupt entry was left at the destination")
+	}
+	if !exists(filepath.Join(tmp, "cache", "ab", "v2-abcd")) {
+		t.Errorf("corrupt entry was removed without the token")
+	}
+}
+
+// TestHTTPChecksumStorePut checks that putting an entry into a remote
+// store uploads it once and never reads it back.
+func TestHTTPChecksumStorePut(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	requests := map[string]int{}
+	var mu sync.Mutex
+	h := newCacheHandler(newDirStore(filepath.Join(tmp, "cache")), "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := newHTTPStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(tmp, "src")
+	if err := ioutil.WriteFile(src, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newChecksumStore(hs)
+	if err := s.Put("v2-abcd", src); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests["GET /v2-abcd"]; n != 0 {
+		t.Errorf("Put read the entry back %d times", n)
+	}
+	if n := requests["PUT /v2-abcd"]; n != 1 {
+		t.Errorf("Put uploaded the entry %d times, want 1", n)
+	}
+	if err := s.Get("v2-abcd", filepath.Join(tmp, "dst")); err != nil {
+		t.Fatalf("Get after Put: %v", err)
+	}
+}
+
+// TestCacheServerTimeout checks that a client which stalls in the
+// middle of a PUT does not keep the cache directory locked.
+func TestCacheServerTimeout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ds := newDirStore(filepath.Join(tmp, "cache"))
+	srv := newCacheServer("localhost:0", newCacheHandler(ds, ""))
+	srv.ReadTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "PUT /v2-abcd HTTP/1.1\r\nHost: x\r\nContent-Length: 100\r\n\r\npartial"); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		// Give the server time to take the shared lock first.
+		time.Sleep(20 * time.Millisecond)
+		unlock, err := ds.Lock(true)
+		if err == nil {
+			unlock()
+		}
+		locked <- err
+	}()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled PUT kept the cache locked")
+	}
+	if ok, _ := ds.Has("v2-abcd"); ok {
+		t.Errorf("a partial PUT added the entry")
+	}
+}
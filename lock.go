@@ -0,0 +1,113 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Processes sharing a cache directory coordinate using advisory file
+// locks. Commands which read or add entries hold a shared lock on the
+// whole cache for as long as they run; commands which remove entries,
+// such as clear, hold an exclusive lock. Writing or deleting a single
+// entry additionally holds an exclusive lock on that entry.
+
+const (
+	// cacheLockName is the lock file for the whole cache directory.
+	cacheLockName = ".lock"
+	// entryLockDir is the directory holding the lock files for
+	// individual entries.
+	entryLockDir = ".locks"
+)
+
+// A locker is a Store which can be locked against use by other
+// processes.
+type locker interface {
+	// Lock acquires a lock on the whole store, shared unless exclusive
+	// is set, and returns the function which releases it.
+	Lock(exclusive bool) (unlock func(), err error)
+}
+
+// lockStore locks s if it supports locking and returns the function
+// which releases the lock.
+func lockStore(s Store, exclusive bool) func() {
+	l, ok := s.(locker)
+	if !ok {
+		return func() {}
+	}
+	unlock, err := l.Lock(exclusive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return unlock
+}
+
+// lockFile opens the lock file at path, creating it if necessary, and
+// locks it. Closing the returned file releases the lock.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, exclusive); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *dirStore) Lock(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := lockFile(filepath.Join(s.dir, cacheLockName), exclusive)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if exclusive {
+			// No other process can be holding an entry lock, so this
+			// is the one time the entry lock files can be removed.
+			_ = os.RemoveAll(filepath.Join(s.dir, entryLockDir))
+		}
+		_ = f.Close()
+	}, nil
+}
+
+// lockEntry acquires the exclusive lock on the entry for key and
+// returns the function which releases it. The lock files are sharded
+// like the entries so that no single directory holds one for every
+// entry.
+func (s *dirStore) lockEntry(key string) (func(), error) {
+	path := shardPath(filepath.Join(s.dir, entryLockDir), key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := lockFile(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = f.Close() }, nil
+}
+
+func (s *checksumStore) Lock(exclusive bool) (func(), error) {
+	if l, ok := s.Store.(locker); ok {
+		return l.Lock(exclusive)
+	}
+	return func() {}, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockEntrySharded(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s := newDirStore(tmp)
+	for _, key := range []string{"v2-abcd", "v2-abcd.meta", "0123", statsFile} {
+		unlock, err := s.lockEntry(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+	}
+	for _, path := range []string{"ab/v2-abcd", "ab/v2-abcd.meta", "01/0123", statsFile} {
+		if !exists(filepath.Join(tmp, entryLockDir, filepath.FromSlash(path))) {
+			t.Errorf("no lock file %s", path)
+		}
+	}
+
+	unlock, err := s.Lock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if exists(filepath.Join(tmp, entryLockDir)) {
+		t.Errorf("entry locks not removed by the exclusive unlock")
+	}
+}
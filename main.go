@@ -20,10 +20,10 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"time"
 )
 
@@ -42,14 +42,18 @@ func exists(path string) bool {
 	return true
 }
 
-func cacheDir() string {
-	d := os.Getenv("CACHE")
-	if d == "" {
-		d = os.ExpandEnv("${HOME}/buildcache")
+// fileSize returns the size of the file at path, or 0 if it cannot be
+// determined.
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
 	}
-	return d
+	return fi.Size()
 }
 
+// linkOrCopy hard links src to dst, falling back to copying it. dst is
+// left alone if it already exists.
 func linkOrCopy(src, dst string) error {
 	if exists(dst) {
 		return nil
@@ -64,113 +68,264 @@ func linkOrCopy(src, dst string) error {
 	}
 	defer srcFile.Close()
 
-	srcInfo, err := os.Stat(src)
+	srcInfo, err := srcFile.Stat()
 	if err != nil {
 		return err
 	}
+	return writeAtomic(dst, srcInfo.Mode()&os.ModePerm, srcFile)
+}
 
-	dstFile, err := os.Create(dst)
+// openCache returns the Store for the cache location, verifying the
+// checksum of every entry read from it and decompressing compressed
+// entries.
+func openCache() Store {
+	return openCompressedCache("")
+}
+
+// openCompressedCache is like openCache, but the entries put into the
+// returned Store are compressed with the named codec.
+func openCompressedCache(compression string) Store {
+	s, err := openStore(cacheLocation())
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	defer dstFile.Close()
-	if err := dstFile.Chmod(srcInfo.Mode() & os.ModePerm); err != nil {
-		_ = os.Remove(dst)
-		return err
+	cs, err := newCompressStore(newChecksumStore(s), compression)
+	if err != nil {
+		log.Fatal(err)
 	}
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	return cs
+}
+
+// packagesToCache returns the packages in pkgs whose installed output
+// save and restore operate on. The standard library is installed
+// along with the toolchain unless the build options rebuild it.
+func packagesToCache(pkgs []*Package) []*Package {
+	var result []*Package
+	for _, pkg := range pkgs {
+		if pkg.Standard && !pkg.options.rebuildsStd() {
+			continue
+		}
+		result = append(result, pkg)
+	}
+	return result
 }
 
 func save(args []string) {
+	flags := flag.NewFlagSet("save", flag.ExitOnError)
+	gocache := flags.Bool("gocache", false, "save the go command's GOCACHE entries instead of installed packages")
+	jsonOutput := flags.Bool("json", false, "print one JSON record per package to stdout")
+	j := flags.Int("j", runtime.NumCPU(), "number of packages to fingerprint and save in parallel")
+	compress := flags.String("compress", "", "compress new entries with this codec (gzip, zstd)")
+	platform := flags.String("platform", "", "cross-compile for this GOOS/GOARCH (e.g. linux/arm64)")
+	tests := flags.Bool("tests", false, "also save the packages imported by tests")
+	testbin := flags.String("testbin", "", "also save the test binaries built by go test -c, building missing ones into this directory (implies -tests)")
+	_ = flags.Parse(args)
+	args = flags.Args()
 	if len(args) == 0 {
 		args = []string{"."}
 	}
+	args = withPlatform(args, *platform)
+	*tests = *tests || *testbin != ""
 
-	dir := cacheDir()
-	log.Printf("saving %s to %s", args, dir)
-	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+	s := openCompressedCache(*compress)
+	defer lockStore(s, false)()
+	log.Printf("saving %s to %s", args, s)
+
+	tc := goToolchain()
+	log.Printf("toolchain: %s", tc)
+	if err := saveToolchain(s, tc); err != nil {
 		log.Fatal(err)
 	}
 
 	start := time.Now()
-	pkgs := loadAll(args)
+	pkgs := loadAll(args, *tests)
 	log.Printf("finished loading: %s", time.Since(start))
 
-	for _, pkg := range pkgs {
-		if pkg.Standard && !pkg.race {
-			continue
-		}
-		if pkg.Stale || !exists(pkg.Target) {
-			log.Printf("%-40s  %s (%s)", "-", pkg.ImportPath, pkg.Target)
+	rep := newReporter("save", *jsonOutput)
+	defer rep.finish(s)
+	if *testbin != "" {
+		saveTestBinaries(s, pkgs, *testbin, *j, rep)
+	}
+	if *gocache {
+		saveGocache(s, args, *tests, pkgs, *j, rep)
+		return
+	}
+
+	pkgs = packagesToCache(pkgs)
+	start = time.Now()
+	fingerprintAll(pkgs, *j)
+	log.Printf("finished fingerprinting: %s", time.Since(start))
+
+	parallel(len(pkgs), *j, func(i int) {
+		pkg := pkgs[i]
+		start := time.Now()
+		r := packageRecord{ImportPath: pkg.ImportPath, Target: pkg.Target}
+		if pkg.Stale {
+			r.Action, r.Reason = actionSkipped, "stale"
+		} else if !exists(pkg.Target) {
+			r.Action, r.Reason = actionSkipped, "not installed"
 		} else {
-			fp := pkg.Fingerprint()
-			tag := "*"
-			dst := filepath.Join(dir, fp)
-			if exists(dst) {
-				tag = " "
-			} else if err := linkOrCopy(pkg.Target, dst); err != nil {
+			r.Fingerprint = pkg.Fingerprint()
+			ok, err := s.Has(r.Fingerprint)
+			if err != nil {
 				log.Fatal(err)
 			}
-			log.Printf("%-40s %s%s (%s)", fp, tag, pkg.ImportPath, pkg.Target)
+			if ok {
+				r.Action = actionCached
+			} else {
+				if err := putEntry(s, r.Fingerprint, pkg.Target, packageMeta(pkg)); err != nil {
+					log.Fatal(err)
+				}
+				if err := saveManifest(s, pkg); err != nil {
+					log.Fatal(err)
+				}
+				r.Action = actionSaved
+				r.Bytes = fileSize(pkg.Target)
+			}
 		}
-	}
+		rep.record(r, start)
+	})
 }
 
 func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	gocache := flags.Bool("gocache", false, "restore the go command's GOCACHE entries instead of installed packages")
+	jsonOutput := flags.Bool("json", false, "print one JSON record per package to stdout")
+	j := flags.Int("j", runtime.NumCPU(), "number of packages to fingerprint and restore in parallel")
+	platform := flags.String("platform", "", "cross-compile for this GOOS/GOARCH (e.g. linux/arm64)")
+	tests := flags.Bool("tests", false, "also restore the packages imported by tests")
+	testbin := flags.String("testbin", "", "also restore the test binaries built by go test -c into this directory (implies -tests)")
+	_ = flags.Parse(args)
+	args = flags.Args()
 	if len(args) == 0 {
 		args = []string{"."}
 	}
+	args = withPlatform(args, *platform)
+	*tests = *tests || *testbin != ""
 
-	dir := cacheDir()
-	if !exists(dir) {
-		log.Printf("%s does not exist", dir)
-		os.Exit(0)
-	}
-	log.Printf("restoring %s from %s", args, dir)
+	s := openCache()
+	defer lockStore(s, false)()
+	log.Printf("restoring %s from %s", args, s)
+
+	tc := goToolchain()
+	log.Printf("toolchain: %s", tc)
+	checkToolchain(s, tc)
 
 	start := time.Now()
-	pkgs := loadAll(args)
+	pkgs := loadAll(args, *tests)
 	log.Printf("finished loading: %s", time.Since(start))
 
+	rep := newReporter("restore", *jsonOutput)
+	defer rep.finish(s)
+	if *testbin != "" {
+		restoreTestBinaries(s, pkgs, *testbin, *j, rep)
+	}
+	if *gocache {
+		restoreGocache(s, pkgs, *j, rep)
+		return
+	}
+
+	pkgs = packagesToCache(pkgs)
+	start = time.Now()
+	fingerprintAll(pkgs, *j)
+	log.Printf("finished fingerprinting: %s", time.Since(start))
+
 	now := time.Now()
-	for _, pkg := range pkgs {
-		if pkg.Standard && !pkg.race {
-			continue
+	parallel(len(pkgs), *j, func(i int) {
+		pkg := pkgs[i]
+		start := time.Now()
+		r := packageRecord{ImportPath: pkg.ImportPath, Target: pkg.Target, Fingerprint: pkg.Fingerprint()}
+		ok, err := s.Has(r.Fingerprint)
+		if err != nil {
+			log.Fatal(err)
 		}
-		fp := pkg.Fingerprint()
-		src := filepath.Join(dir, fp)
-		if !exists(src) {
-			log.Printf("%-40s  %s (%s:%s)", "-", pkg.ImportPath, fp, pkg.Target)
-		} else {
-			log.Printf("%-40s  %s (%s)", fp, pkg.ImportPath, pkg.Target)
-			_ = os.Remove(pkg.Target)
-			_ = os.MkdirAll(filepath.Dir(pkg.Target), 0755)
-			if err := linkOrCopy(src, pkg.Target); err != nil {
+		if !ok {
+			r.Action = actionMissed
+			rep.record(r, start)
+			return
+		}
+		_ = os.Remove(pkg.Target)
+		_ = os.MkdirAll(filepath.Dir(pkg.Target), 0755)
+		if err := s.Get(r.Fingerprint, pkg.Target); err != nil {
+			if !os.IsNotExist(err) {
 				log.Fatal(err)
 			}
-			if err := os.Chtimes(pkg.Target, now, now); err != nil {
+			// The entry was corrupt and has been quarantined.
+			r.Action = actionMissed
+			rep.record(r, start)
+			return
+		}
+		if err := os.Chtimes(pkg.Target, now, now); err != nil {
+			log.Fatal(err)
+		}
+		r.Action = actionRestored
+		r.Bytes = fileSize(pkg.Target)
+		rep.record(r, start)
+	})
+}
+
+func clear(args []string) {
+	flags := flag.NewFlagSet("clear", flag.ExitOnError)
+	olderThan := flags.String("older-than", "", "only remove entries not used within this age (e.g. 7d)")
+	maxSize := flags.String("max-size", "", "remove least recently used entries until the cache fits (e.g. 20GB)")
+	_ = flags.Parse(args)
+
+	// Other processes must not be reading or writing entries while
+	// they are removed.
+	s := openCache()
+	defer lockStore(s, true)()
+	removeStoreTemp(s)
+	if *olderThan == "" && *maxSize == "" {
+		log.Printf("clearing %s", s)
+		entries, err := s.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range entries {
+			if err := s.Delete(e.Key); err != nil && !os.IsNotExist(err) {
 				log.Fatal(err)
 			}
 		}
+		return
 	}
-}
 
-func clear(args []string) {
-	// TODO(pmattis): Instead of removing everything, only clear entries
-	// that are older than a day or week.
-	dir := cacheDir()
-	log.Printf("clearing %s", dir)
-	if err := os.RemoveAll(dir); err != nil {
+	var age time.Duration
+	var size int64
+	var err error
+	if *olderThan != "" {
+		if age, err = parseAge(*olderThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *maxSize != "" {
+		if size, err = parseSize(*maxSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Printf("evicting from %s", s)
+	evicted, err := evict(s, age, size)
+	var total int64
+	for _, e := range evicted {
+		total += e.Size
+		log.Printf("%-40s  %s (%s)", e.Key, formatSize(e.Size), e.ModTime.Format(time.RFC3339))
+	}
+	log.Printf("evicted %d entries, %s", len(evicted), formatSize(total))
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+var hashFlag = flag.String("hash", "sha256", "fingerprint hash: sha256, or sha1 to use a cache saved before fingerprints were versioned by a build-cache compiled with the same Go version")
+
 func main() {
 	log.SetFlags(0)
 
 	flag.Parse()
 	args := flag.Args()
+	if err := setFingerprintScheme(*hashFlag); err != nil {
+		log.Fatal(err)
+	}
 
 	if len(args) >= 1 {
 		switch args[0] {
@@ -183,10 +338,37 @@ func main() {
 		case "clear":
 			clear(args[1:])
 			return
+		case "status":
+			status(args[1:])
+			return
+		case "explain":
+			explain(args[1:])
+			return
+		case "verify":
+			verify(args[1:])
+			return
+		case "list":
+			list(args[1:])
+			return
+		case "show":
+			show(args[1:])
+			return
+		case "stats":
+			stats(args[1:])
+			return
+		case "migrate":
+			migrateCache(args[1:])
+			return
+		case "serve":
+			serve(args[1:])
+			return
+		case "cacheprog":
+			cacheprog(args[1:])
+			return
 		}
 		log.Printf("unknown command \"%s\"\n\n", args[0])
 	}
 
-	log.Printf("usage: %s [save|restore|clear]", os.Args[0])
+	log.Printf("usage: %s [-hash=sha256|sha1] [save|restore|status|explain|list|show|stats|verify|migrate|clear|serve|cacheprog]", os.Args[0])
 	os.Exit(1)
 }
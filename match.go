@@ -0,0 +1,201 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"go/build"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// importPaths expands the "..." patterns and "all" among the package
+// arguments args into the import paths of the packages they match,
+// keeping the build options of each argument.
+func importPaths(args []string) []string {
+	var out []string
+	for _, arg := range args {
+		base := packageBaseImportPath(arg)
+		if base != "all" && !strings.Contains(base, "...") {
+			out = append(out, arg)
+			continue
+		}
+		suffix := arg[len(base):]
+		ctx := newBuildContext(packageBuildOptions(arg))
+		var matches []string
+		switch {
+		case base == "all":
+			matches = matchPackages(ctx, "...")
+		case build.IsLocalImport(base):
+			matches = matchPackagesInFS(ctx, base)
+		default:
+			matches = matchPackages(ctx, base)
+		}
+		if len(matches) == 0 {
+			log.Printf("warning: %q matched no packages", base)
+		}
+		for _, m := range matches {
+			out = append(out, m+suffix)
+		}
+	}
+	return out
+}
+
+// matchPattern returns a function which reports whether a package
+// import path matches pattern, in which "..." matches any string. As
+// with the go command, "foo/..." matches foo itself, and "..." does
+// not match vendored packages unless the pattern mentions vendor.
+func matchPattern(pattern string) func(name string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	// Special case: foo/... matches foo too.
+	if strings.HasSuffix(re, `/.*`) {
+		re = re[:len(re)-len(`/.*`)] + `(/.*)?`
+	}
+	reg := regexp.MustCompile(`^` + re + `$`)
+	vendor := hasPathElem(pattern, "vendor")
+	return func(name string) bool {
+		return reg.MatchString(name) && (vendor || !hasPathElem(name, "vendor"))
+	}
+}
+
+// hasPathElem reports whether the slash-separated path p has an
+// element equal to elem.
+func hasPathElem(p, elem string) bool {
+	for _, e := range strings.Split(p, "/") {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// treeCanMatchPattern returns a function which reports whether the
+// tree rooted at the import path name could contain a match for
+// pattern.
+func treeCanMatchPattern(pattern string) func(name string) bool {
+	wildCard := false
+	if i := strings.Index(pattern, "..."); i >= 0 {
+		wildCard = true
+		pattern = pattern[:i]
+	}
+	return func(name string) bool {
+		return len(name) <= len(pattern) && strings.HasPrefix(pattern, name) ||
+			wildCard && strings.HasPrefix(name, pattern)
+	}
+}
+
+// skipDir returns true if the directory named elem can hold no
+// packages matched by a pattern: the go command ignores testdata and
+// directories beginning with "." or "_".
+func skipDir(elem string) bool {
+	return elem == "testdata" || strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_")
+}
+
+// isPackageDir returns true if dir holds a package buildable with ctx.
+func isPackageDir(ctx *build.Context, dir string) bool {
+	if _, err := ctx.ImportDir(dir, 0); err != nil {
+		if _, noGo := err.(*build.NoGoError); noGo {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPackages returns the import paths of the packages in GOROOT and
+// GOPATH which match pattern.
+func matchPackages(ctx *build.Context, pattern string) []string {
+	match := matchPattern(pattern)
+	treeCanMatch := treeCanMatchPattern(pattern)
+	cmd := filepath.Join(ctx.GOROOT, "src", "cmd") + string(filepath.Separator)
+
+	have := map[string]bool{}
+	var pkgs []string
+	for _, src := range ctx.SrcDirs() {
+		src = filepath.Clean(src) + string(filepath.Separator)
+		_ = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() || p == src {
+				return nil
+			}
+			// The commands in GOROOT are only matched by patterns
+			// naming them.
+			if p+string(filepath.Separator) == cmd && !strings.HasPrefix(pattern, "cmd") {
+				return filepath.SkipDir
+			}
+			if skipDir(fi.Name()) {
+				return filepath.SkipDir
+			}
+			name := filepath.ToSlash(p[len(src):])
+			if !treeCanMatch(name) {
+				return filepath.SkipDir
+			}
+			if have[name] || !match(name) {
+				return nil
+			}
+			have[name] = true
+			if isPackageDir(ctx, p) {
+				pkgs = append(pkgs, name)
+			}
+			return nil
+		})
+	}
+	return pkgs
+}
+
+// matchPackagesInFS returns the packages in the directory tree named
+// by the local pattern, such as "./...", as local import paths.
+func matchPackagesInFS(ctx *build.Context, pattern string) []string {
+	// Find the directory to begin the scan. Could be smarter but
+	// this one optimization is enough for now, since ... is usually
+	// at the end of a path.
+	i := strings.Index(pattern, "...")
+	dir, _ := path.Split(pattern[:i])
+
+	// pattern begins with ./ or ../. path.Clean will discard the ./
+	// but not the ../. We need to preserve the ./ for pattern
+	// matching and in the returned import paths.
+	prefix := ""
+	if strings.HasPrefix(pattern, "./") {
+		prefix = "./"
+	}
+	match := matchPattern(pattern)
+
+	var pkgs []string
+	_ = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if p != dir && skipDir(fi.Name()) {
+			return filepath.SkipDir
+		}
+		// The root might be "." or "./".
+		name := filepath.ToSlash(filepath.Clean(p))
+		if name != "." {
+			name = prefix + name
+		}
+		if !match(name) {
+			return nil
+		}
+		if isPackageDir(ctx, p) {
+			pkgs = append(pkgs, name)
+		}
+		return nil
+	})
+	return pkgs
+}
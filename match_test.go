@@ -0,0 +1,93 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "foo/bar", false},
+		{"foo", "foobar", false},
+		{"foo/...", "foo", true},
+		{"foo/...", "foo/bar", true},
+		{"foo/...", "foo/bar/baz", true},
+		{"foo/...", "foobar", false},
+		{"foo...", "foobar", true},
+		{"foo...", "foo/bar", true},
+		{"foo/.../baz", "foo/bar/baz", true},
+		{"foo/.../baz", "foo/baz", false},
+		{"...", "foo", true},
+		{"...", "foo/vendor/bar", false},
+		{"foo/...", "foo/vendor/bar", false},
+		{"foo/vendor/...", "foo/vendor/bar", true},
+		{"./...", ".", true},
+		{"./...", "./foo", true},
+		{"./...", "../foo", false},
+		{"a.b/...", "axb", false},
+		{"a+b", "a+b", true},
+		{"a+b", "aab", false},
+	}
+	for _, c := range testCases {
+		if got := matchPattern(c.pattern)(c.name); got != c.want {
+			t.Errorf("matchPattern(%q)(%q) = %t, want %t", c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestTreeCanMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"foo/bar", "foo", true},
+		{"foo/bar", "foo/bar", true},
+		{"foo/bar", "foo/bar/baz", false},
+		{"foo/bar", "baz", false},
+		{"foo/...", "foo", true},
+		{"foo/...", "foo/bar/baz", true},
+		{"foo/...", "bar", false},
+		{"...", "anything/at/all", true},
+		{"foo/.../baz", "foo/bar", true},
+	}
+	for _, c := range testCases {
+		if got := treeCanMatchPattern(c.pattern)(c.name); got != c.want {
+			t.Errorf("treeCanMatchPattern(%q)(%q) = %t, want %t", c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestSkipDir(t *testing.T) {
+	testCases := []struct {
+		elem string
+		want bool
+	}{
+		{"testdata", true},
+		{".git", true},
+		{"_obj", true},
+		{"pkg", false},
+		{"vendor", false},
+		{"data_test", false},
+	}
+	for _, c := range testCases {
+		if got := skipDir(c.elem); got != c.want {
+			t.Errorf("skipDir(%q) = %t, want %t", c.elem, got, c.want)
+		}
+	}
+}
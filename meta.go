@@ -0,0 +1,258 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metaKey returns the store key for the metadata of the entry for key.
+func metaKey(key string) string {
+	return key + ".meta"
+}
+
+// entryMeta is the metadata recorded for a cache entry, describing
+// what it holds and where it came from. Entries saved before metadata
+// was introduced have none and are uncompressed.
+type entryMeta struct {
+	ImportPath  string    `json:",omitempty"`
+	Target      string    `json:",omitempty"` // relative to its GOPATH entry or GOROOT
+	Toolchain   string    `json:",omitempty"` // the go version
+	Options     []string  `json:",omitempty"` // build options, such as race
+	Created     time.Time // when the entry was saved
+	Size        int64     // uncompressed size in bytes
+	Checksum    string    // SHA-256 of the uncompressed contents
+	Host        string    `json:",omitempty"` // the host which saved the entry
+	Compression string    `json:",omitempty"` // the codec; empty if uncompressed
+}
+
+// packageMeta returns the metadata describing the entry for pkg.
+// putEntry fills in the details of the entry itself.
+func packageMeta(pkg *Package) entryMeta {
+	m := entryMeta{
+		ImportPath: pkg.baseImportPath,
+		Target:     pkg.Target,
+		Toolchain:  goToolchain().Version,
+	}
+	if m.ImportPath == "" {
+		m.ImportPath = pkg.ImportPath
+	}
+	if pkg.Root != "" && pkg.Target != "" {
+		if rel, err := filepath.Rel(pkg.Root, pkg.Target); err == nil {
+			m.Target = rel
+		}
+	}
+	m.Options = pkg.options.list()
+	return m
+}
+
+// putEntry stores the local file src as the entry for key along with
+// the metadata m, if s records metadata.
+func putEntry(s Store, key, src string, m entryMeta) error {
+	if cs, ok := s.(*compressStore); ok {
+		return cs.putEntry(key, src, m)
+	}
+	return s.Put(key, src)
+}
+
+// readMeta returns the metadata of the entry for key. An entry without
+// metadata has the zero entryMeta. The metadata is read in place where
+// s allows it.
+func readMeta(s Store, key string) (entryMeta, error) {
+	var m entryMeta
+	b, err := readBytes(s, metaKey(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// A listedEntry is an entry in the cache along with its metadata.
+type listedEntry struct {
+	Entry
+	Meta entryMeta
+}
+
+// listEntries returns the entries in s, other than sidecars and
+// bookkeeping, with their metadata.
+func listEntries(s Store) ([]listedEntry, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var listed []listedEntry
+	for _, e := range entries {
+		if !compressible(e.Key) {
+			continue
+		}
+		m, err := readMeta(s, e.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", e.Key, err)
+		}
+		listed = append(listed, listedEntry{Entry: e, Meta: m})
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].Key < listed[j].Key
+	})
+	return listed, nil
+}
+
+// created returns when the entry was saved. Entries without metadata
+// fall back to when they were last written or restored.
+func (e *listedEntry) created() time.Time {
+	if !e.Meta.Created.IsZero() {
+		return e.Meta.Created
+	}
+	return e.ModTime
+}
+
+// listSorts maps the values of list's -sort flag to the ordering they
+// select. Ties are broken by key.
+var listSorts = map[string]func(a, b *listedEntry) bool{
+	"key":    func(a, b *listedEntry) bool { return false },
+	"size":   func(a, b *listedEntry) bool { return a.Size > b.Size },
+	"age":    func(a, b *listedEntry) bool { return a.created().Before(b.created()) },
+	"access": func(a, b *listedEntry) bool { return a.ModTime.Before(b.ModTime) },
+}
+
+// list prints the entries in the cache with their size, age, last
+// access and import path.
+func list(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only list entries for import paths with this prefix")
+	olderThan := flags.String("older-than", "", "only list entries saved longer ago than this age (e.g. 7d)")
+	newerThan := flags.String("newer-than", "", "only list entries saved within this age (e.g. 1d)")
+	option := flags.String("option", "", "only list entries built with this build option (e.g. race)")
+	sortBy := flags.String("sort", "key", "sort by key, size (largest first), age or access (oldest first)")
+	_ = flags.Parse(args)
+
+	less, ok := listSorts[*sortBy]
+	if !ok {
+		log.Fatalf("invalid sort %q", *sortBy)
+	}
+	var minAge, maxAge time.Duration
+	var err error
+	if *olderThan != "" {
+		if minAge, err = parseAge(*olderThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *newerThan != "" {
+		if maxAge, err = parseAge(*newerThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Only the metadata is read, which the underlying store can do
+	// in place without copying it or marking it as used.
+	s, err := openStore(cacheLocation())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lockStore(s, false)()
+	listed, err := listEntries(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	var matched []listedEntry
+	for _, e := range listed {
+		age := now.Sub(e.created())
+		switch {
+		case *prefix != "" && !strings.HasPrefix(e.Meta.ImportPath, *prefix):
+		case *olderThan != "" && age < minAge:
+		case *newerThan != "" && age > maxAge:
+		case *option != "" && !contains(e.Meta.Options, *option):
+		default:
+			matched = append(matched, e)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return less(&matched[i], &matched[j])
+	})
+
+	width := 0
+	for _, e := range matched {
+		if len(e.Key) > width {
+			width = len(e.Key)
+		}
+	}
+	var total int64
+	for _, e := range matched {
+		total += e.Size
+		importPath := e.Meta.ImportPath
+		if importPath == "" {
+			importPath = "-"
+		}
+		fmt.Printf("%-*s  %8s  %5s  %5s  %s\n", width, e.Key, formatSize(e.Size),
+			formatAge(now.Sub(e.created())), formatAge(now.Sub(e.ModTime)), importPath)
+	}
+	log.Printf("%d of %d entries, %s", len(matched), len(listed), formatSize(total))
+}
+
+// show prints the metadata of the entries for the given fingerprints.
+func show(args []string) {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		log.Fatal("usage: build-cache show <fingerprint>...")
+	}
+
+	s, err := openStore(cacheLocation())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lockStore(s, false)()
+	missing := false
+	for _, fp := range flags.Args() {
+		found := false
+		for _, key := range []string{fp, gocacheKey(fp)} {
+			e, err := s.Stat(key)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				log.Fatal(err)
+			}
+			m, err := readMeta(s, key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			found = true
+			fmt.Println(prettyJSON(listedEntry{Entry: e, Meta: m}))
+		}
+		if !found {
+			log.Printf("%s: not in the cache", fp)
+			missing = true
+		}
+	}
+	if missing {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestListEntries checks that listing reads the metadata of each entry
+// without marking it as used.
+func TestListEntries(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "cache")
+	writeFiles(t, dir, map[string]string{
+		"ab/v2-abcd":         "entry",
+		"ab/v2-abcd.meta":    `{"ImportPath":"example.com/a","Size":5}`,
+		"ab/v2-abcd.sha256":  "0000",
+		"cd/v2-cdef.gocache": "bundle",
+		statsFile:            "{}\n",
+	})
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"ab/v2-abcd", "ab/v2-abcd.meta", "cd/v2-cdef.gocache"} {
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(name)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed, err := listEntries(newDirStore(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		key, importPath string
+	}{
+		{"v2-abcd", "example.com/a"},
+		{"v2-cdef.gocache", ""},
+	}
+	if len(listed) != len(testCases) {
+		t.Fatalf("listed %d entries, want %d: %+v", len(listed), len(testCases), listed)
+	}
+	for i, c := range testCases {
+		if e := listed[i]; e.Key != c.key || e.Meta.ImportPath != c.importPath {
+			t.Errorf("entry %d = %s (%q), want %s (%q)", i, e.Key, e.Meta.ImportPath, c.key, c.importPath)
+		}
+	}
+	for _, name := range []string{"ab/v2-abcd", "ab/v2-abcd.meta", "cd/v2-cdef.gocache"} {
+		if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil || !fi.ModTime().Equal(old) {
+			t.Errorf("listing touched %s: %v", name, err)
+		}
+	}
+}
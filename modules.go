@@ -0,0 +1,234 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Module describes the module containing a package, as reported by
+// "go list".
+type Module struct {
+	Path    string  // module path
+	Version string  // module version
+	Replace *Module // replaced by this module
+	Main    bool    // is this the main module?
+	Dir     string  // directory holding files for this module, if any
+	GoMod   string  // path to go.mod file for this module, if any
+}
+
+// moduleMode returns true if the go command on PATH loads packages
+// using modules rather than GOPATH. Outside of any module GOMOD is
+// os.DevNull, and there is no main module to load packages from.
+func moduleMode() bool {
+	gomod := goToolchain().GOMOD
+	return gomod != "" && gomod != os.DevNull
+}
+
+var (
+	theGoSum     map[string]string
+	theGoSumOnce sync.Once
+)
+
+// goSum returns the contents of the main module's go.sum, keyed by
+// "path version".
+func goSum() map[string]string {
+	theGoSumOnce.Do(func() {
+		theGoSum = readGoSum()
+	})
+	return theGoSum
+}
+
+func readGoSum() map[string]string {
+	sums := map[string]string{}
+	gomod := goToolchain().GOMOD
+	if gomod == "" || gomod == os.DevNull {
+		return sums
+	}
+	f, err := os.Open(filepath.Join(filepath.Dir(gomod), "go.sum"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		return sums
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is "path version hash". The "path version/go.mod"
+		// lines only cover the go.mod file and are not needed.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return sums
+}
+
+// moduleFlags returns the facts about the module containing p which
+// are included in its fingerprint. The main module has no version;
+// its sources are fingerprinted directly.
+func (p *Package) moduleFlags() []string {
+	m := p.Module
+	if m == nil || m.Main {
+		return nil
+	}
+	if m.Replace != nil {
+		m = m.Replace
+	}
+	return []string{m.Path, m.Version, goSum()[m.Path+" "+m.Version]}
+}
+
+// loadModulePackages is the module mode equivalent of packagesForBuild.
+// It runs "go list -deps" once for each distinct set of build options
+// and returns the packages named on the command line along with their
+// dependencies.
+func loadModulePackages(args []string, tests bool) []*Package {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	optionSets, patterns := groupByOptions(args)
+	var all []*Package
+	for _, opts := range optionSets {
+		all = append(all, goList(opts, patterns[opts.String()], tests)...)
+	}
+
+	errors := 0
+	printed := map[*PackageError]bool{}
+	for _, pkg := range all {
+		if pkg.Error != nil && !printed[pkg.Error] {
+			printed[pkg.Error] = true
+			if pkg.DepOnly {
+				log.Printf("%s", pkg.Error)
+			} else {
+				log.Printf("can't load package: %s", pkg.Error)
+			}
+			errors++
+		}
+	}
+	if errors > 0 {
+		os.Exit(1)
+	}
+	return all
+}
+
+// goList loads the packages matching patterns and all of their
+// dependencies using "go list -deps -json". If tests is set, the
+// dependencies of their tests are included too.
+func goList(options buildOptions, patterns []string, tests bool) []*Package {
+	listArgs := []string{"list", "-e", "-deps", "-json"}
+	if tests {
+		listArgs = append(listArgs, "-test")
+	}
+	listArgs = append(listArgs, options.goFlags()...)
+	listArgs = append(listArgs, patterns...)
+
+	cmd := exec.Command("go", listArgs...)
+	cmd.Env = append(os.Environ(), options.goEnv()...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		log.Fatalf("go %s: %s\n%s", strings.Join(listArgs[1:], " "), err, stderr.Bytes())
+	}
+
+	var pkgs []*Package
+	byPath := map[string]*Package{}
+	testImportMap := map[string]map[string]string{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		p := new(Package)
+		if err := dec.Decode(p); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		if isTestVariant(p.ImportPath) {
+			// The test binaries and packages recompiled for them
+			// are not installed or cached, but the ImportMap of the
+			// test packages resolves the imports of the tests.
+			if forTest := testVariantOf(p.ImportPath); forTest != "" {
+				if testImportMap[forTest] == nil {
+					testImportMap[forTest] = map[string]string{}
+				}
+				for path, m := range p.ImportMap {
+					testImportMap[forTest][path] = m
+				}
+			}
+			continue
+		}
+		p.baseImportPath = p.ImportPath
+		p.options = options
+		byPath[p.ImportPath] = p
+		pkgs = append(pkgs, p)
+	}
+
+	// Link up imports and dependencies, and rename the packages to
+	// distinguish the build options as loadImport does.
+	for _, p := range pkgs {
+		for _, path := range p.Imports {
+			if m, ok := p.ImportMap[path]; ok {
+				path = m
+			}
+			if p1 := byPath[path]; p1 != nil {
+				p.imports = append(p.imports, p1)
+			}
+		}
+		for _, path := range p.Deps {
+			if p1 := byPath[path]; p1 != nil {
+				p.deps = append(p.deps, p1)
+			}
+		}
+		if tests {
+			for _, path := range stringList(p.TestImports, p.XTestImports) {
+				if m, ok := p.ImportMap[path]; ok {
+					path = m
+				} else if m, ok := testImportMap[p.ImportPath][path]; ok {
+					path = m
+				}
+				// A package imported by the tests may itself be
+				// recompiled for them; the cached form is the
+				// regular one.
+				if i := strings.Index(path, " ["); i >= 0 {
+					path = path[:i]
+				}
+				if p1 := byPath[path]; p1 != nil && p1 != p {
+					p.testImports = append(p.testImports, p1)
+				}
+			}
+		}
+		p.ImportPath = options.importPath(p.ImportPath)
+	}
+	for _, p := range pkgs {
+		sort.Sort(packageList(p.deps))
+	}
+	return pkgs
+}
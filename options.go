@@ -0,0 +1,256 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"log"
+	"sort"
+	"strings"
+)
+
+// buildOptions are the build options which may follow the import path
+// in a package argument, separated by commas, as in
+// "pkg:race,deadlock,buildmode=pie". A bare word is a build tag; the
+// race, msan and asan tags also build the package with that
+// instrumentation, as the go command's flags of the same name do.
+// "installsuffix=" and "buildmode=" set the corresponding go command
+// flags, and "goos=" and "goarch=" cross-compile for another platform.
+type buildOptions struct {
+	Tags          []string // sorted
+	InstallSuffix string
+	BuildMode     string
+	GOOS          string // empty for the toolchain's
+	GOARCH        string // empty for the toolchain's
+}
+
+// instrumentModes are the build tags which also select an
+// instrumentation mode. Each mode adds itself to the install suffix
+// and makes every package depend on runtime/<mode>.
+var instrumentModes = []string{"race", "msan", "asan"}
+
+// buildModeSuffixes maps a build mode to the install suffix the go
+// command uses for packages compiled for it.
+var buildModeSuffixes = map[string]string{
+	"default":   "",
+	"archive":   "",
+	"exe":       "",
+	"pie":       "shared",
+	"c-archive": "shared",
+	"c-shared":  "shared",
+	"shared":    "dynlink",
+	"plugin":    "dynlink",
+}
+
+// parseBuildOptions parses the options of a package argument.
+func parseBuildOptions(opts []string) (buildOptions, error) {
+	var o buildOptions
+	for _, opt := range opts {
+		if opt == "" {
+			continue
+		}
+		i := strings.IndexByte(opt, '=')
+		if i == -1 {
+			if !contains(o.Tags, opt) {
+				o.Tags = append(o.Tags, opt)
+			}
+			continue
+		}
+		switch key, value := opt[:i], opt[i+1:]; key {
+		case "installsuffix":
+			o.InstallSuffix = value
+		case "buildmode":
+			if _, ok := buildModeSuffixes[value]; !ok {
+				return o, fmt.Errorf("unknown build mode %q", value)
+			}
+			o.BuildMode = value
+		case "goos":
+			o.GOOS = value
+		case "goarch":
+			o.GOARCH = value
+		default:
+			return o, fmt.Errorf("unknown build option %q", key)
+		}
+	}
+	sort.Strings(o.Tags)
+	var modes []string
+	for _, mode := range instrumentModes {
+		if contains(o.Tags, mode) {
+			modes = append(modes, mode)
+		}
+	}
+	if len(modes) > 1 {
+		return o, fmt.Errorf("build options %s are mutually exclusive", strings.Join(modes, " and "))
+	}
+	return o, nil
+}
+
+// packageBuildOptions returns the build options of the package
+// argument arg.
+func packageBuildOptions(arg string) buildOptions {
+	o, err := parseBuildOptions(packageOptions(arg))
+	if err != nil {
+		log.Fatalf("%s: %s", arg, err)
+	}
+	return o
+}
+
+// list returns the options in canonical order.
+func (o buildOptions) list() []string {
+	opts := append([]string(nil), o.Tags...)
+	if o.BuildMode != "" {
+		opts = append(opts, "buildmode="+o.BuildMode)
+	}
+	if o.InstallSuffix != "" {
+		opts = append(opts, "installsuffix="+o.InstallSuffix)
+	}
+	if o.GOOS != "" {
+		opts = append(opts, "goos="+o.GOOS)
+	}
+	if o.GOARCH != "" {
+		opts = append(opts, "goarch="+o.GOARCH)
+	}
+	return opts
+}
+
+// String returns the options in the canonical form in which they
+// follow import paths. It is empty if there are no options.
+func (o buildOptions) String() string {
+	return strings.Join(o.list(), ",")
+}
+
+// instrument returns the instrumentation mode, if any.
+func (o buildOptions) instrument() string {
+	for _, mode := range instrumentModes {
+		if contains(o.Tags, mode) {
+			return mode
+		}
+	}
+	return ""
+}
+
+// installSuffix returns the install suffix of packages built with o,
+// composed as the go command does.
+func (o buildOptions) installSuffix() string {
+	suffix := o.InstallSuffix
+	for _, s := range []string{o.instrument(), buildModeSuffixes[o.BuildMode]} {
+		if s == "" {
+			continue
+		}
+		if suffix != "" {
+			suffix += "_"
+		}
+		suffix += s
+	}
+	return suffix
+}
+
+// crossCompiles returns true if o builds for a platform other than
+// the toolchain's.
+func (o buildOptions) crossCompiles() bool {
+	tc := goToolchain()
+	return o.GOOS != "" && o.GOOS != tc.GOOS || o.GOARCH != "" && o.GOARCH != tc.GOARCH
+}
+
+// rebuildsStd returns true if packages built with o use their own
+// build of the standard library rather than the one installed with
+// the toolchain.
+func (o buildOptions) rebuildsStd() bool {
+	return o.installSuffix() != "" || o.crossCompiles()
+}
+
+// apply sets the build tags, install suffix and platform of ctx. Cgo
+// is enabled as the go command enables it for the platform: when
+// cross-compiling, that is only if CGO_ENABLED=1 is set.
+func (o buildOptions) apply(ctx *build.Context) {
+	ctx.BuildTags = append(append([]string(nil), ctx.BuildTags...), o.Tags...)
+	ctx.InstallSuffix = o.installSuffix()
+	if o.GOOS != "" {
+		ctx.GOOS = o.GOOS
+	}
+	if o.GOARCH != "" {
+		ctx.GOARCH = o.GOARCH
+	}
+	if o.crossCompiles() {
+		ctx.CgoEnabled = o.targetToolchain().CGOEnabled == "1"
+	}
+}
+
+// goEnv returns the environment variables which select the platform
+// of o for the go command.
+func (o buildOptions) goEnv() []string {
+	var env []string
+	if o.GOOS != "" {
+		env = append(env, "GOOS="+o.GOOS)
+	}
+	if o.GOARCH != "" {
+		env = append(env, "GOARCH="+o.GOARCH)
+	}
+	return env
+}
+
+// goFlags returns the go command flags which select o.
+func (o buildOptions) goFlags() []string {
+	var flags, tags []string
+	for _, tag := range o.Tags {
+		if tag == o.instrument() {
+			flags = append(flags, "-"+tag)
+		} else {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		flags = append(flags, "-tags="+strings.Join(tags, ","))
+	}
+	if o.BuildMode != "" {
+		flags = append(flags, "-buildmode="+o.BuildMode)
+	}
+	if o.InstallSuffix != "" {
+		flags = append(flags, "-installsuffix="+o.InstallSuffix)
+	}
+	return flags
+}
+
+// withPlatform adds the platform, given as GOOS/GOARCH, to the options
+// of each of the package arguments args which does not name one.
+func withPlatform(args []string, platform string) []string {
+	if platform == "" {
+		return args
+	}
+	i := strings.IndexByte(platform, '/')
+	if i <= 0 || i == len(platform)-1 {
+		log.Fatalf("invalid platform %q: want GOOS/GOARCH", platform)
+	}
+	result := make([]string, len(args))
+	for j, arg := range args {
+		o := packageBuildOptions(arg)
+		if o.GOOS == "" && o.GOARCH == "" {
+			o.GOOS, o.GOARCH = platform[:i], platform[i+1:]
+		}
+		result[j] = o.importPath(packageBaseImportPath(arg))
+	}
+	return result
+}
+
+// importPath returns path qualified by the options, which distinguishes
+// the same package built with different options.
+func (o buildOptions) importPath(path string) string {
+	if s := o.String(); s != "" {
+		return path + ":" + s
+	}
+	return path
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBuildOptions(t *testing.T) {
+	testCases := []struct {
+		in            string
+		want          string // canonical form, or the error
+		installSuffix string
+		goFlags       string
+	}{
+		{"", "", "", ""},
+		{"race", "race", "race", "-race"},
+		{"deadlock,race,deadlock", "deadlock,race", "race", "-race -tags=deadlock"},
+		{"b,a,,c", "a,b,c", "", "-tags=a,b,c"},
+		{"msan,installsuffix=foo", "msan,installsuffix=foo", "foo_msan", "-msan -installsuffix=foo"},
+		{"buildmode=pie", "buildmode=pie", "shared", "-buildmode=pie"},
+		{"buildmode=default", "buildmode=default", "", "-buildmode=default"},
+		{"race,buildmode=shared,installsuffix=x", "race,buildmode=shared,installsuffix=x", "x_race_dynlink", "-race -buildmode=shared -installsuffix=x"},
+		{"goarch=arm64,goos=linux", "goos=linux,goarch=arm64", "", ""},
+		{"buildmode=bogus", `unknown build mode "bogus"`, "", ""},
+		{"buildmode=", `unknown build mode ""`, "", ""},
+		{"gcflags=-N", `unknown build option "gcflags"`, "", ""},
+		{"race,msan", "build options race and msan are mutually exclusive", "", ""},
+		{"asan,msan,race", "build options race and msan and asan are mutually exclusive", "", ""},
+	}
+	for _, c := range testCases {
+		var opts []string
+		if c.in != "" {
+			opts = strings.Split(c.in, ",")
+		}
+		o, err := parseBuildOptions(opts)
+		if err != nil {
+			if err.Error() != c.want {
+				t.Errorf("parseBuildOptions(%q): %s, want %q", c.in, err, c.want)
+			}
+			continue
+		}
+		if got := o.String(); got != c.want {
+			t.Errorf("parseBuildOptions(%q) = %q, want %q", c.in, got, c.want)
+		}
+		if got := o.installSuffix(); got != c.installSuffix {
+			t.Errorf("parseBuildOptions(%q).installSuffix() = %q, want %q", c.in, got, c.installSuffix)
+		}
+		if got := strings.Join(o.goFlags(), " "); got != c.goFlags {
+			t.Errorf("parseBuildOptions(%q).goFlags() = %q, want %q", c.in, got, c.goFlags)
+		}
+
+		// The canonical form parses back to the same options.
+		if o2, err := parseBuildOptions(packageOptions(o.importPath("p"))); err != nil || o2.String() != o.String() {
+			t.Errorf("%q does not round trip: %q, %v", o.importPath("p"), o2, err)
+		}
+	}
+}
+
+func TestPackageOptions(t *testing.T) {
+	testCases := []struct {
+		arg, base string
+		opts      []string
+	}{
+		{"github.com/a/b", "github.com/a/b", nil},
+		{"github.com/a/b:race", "github.com/a/b", []string{"race"}},
+		{"./...:race,goos=linux", "./...", []string{"race", "goos=linux"}},
+		{"all:", "all", []string{""}},
+	}
+	for _, c := range testCases {
+		base, opts := packageBaseImportPath(c.arg), packageOptions(c.arg)
+		if base != c.base || strings.Join(opts, ",") != strings.Join(c.opts, ",") || (opts == nil) != (c.opts == nil) {
+			t.Errorf("%q: base %q, options %q; want %q, %q", c.arg, base, opts, c.base, c.opts)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"sync"
+)
+
+// fingerprintAll computes the fingerprints of pkgs using up to j
+// goroutines. A package is only fingerprinted once the fingerprints
+// of its dependencies are done, so Package.Fingerprint always finds
+// them memoized and never recurses concurrently. The packages imported
+// by the tests of pkgs, if loaded, are fingerprinted too.
+func fingerprintAll(pkgs []*Package, j int) {
+	if j < 1 {
+		j = 1
+	}
+	sem := make(chan struct{}, j)
+	done := map[*Package]chan struct{}{}
+
+	var schedule func(p *Package) chan struct{}
+	schedule = func(p *Package) chan struct{} {
+		if ch, ok := done[p]; ok {
+			return ch
+		}
+		ch := make(chan struct{})
+		done[p] = ch
+
+		var waits []chan struct{}
+		for _, dep := range p.fingerprintDeps() {
+			waits = append(waits, schedule(dep))
+		}
+		// The fingerprint of a test binary needs those of the
+		// packages its tests import, which p does not wait for.
+		for _, p1 := range p.testImports {
+			schedule(p1)
+		}
+		go func() {
+			for _, w := range waits {
+				<-w
+			}
+			sem <- struct{}{}
+			p.Fingerprint()
+			<-sem
+			close(ch)
+		}()
+		return ch
+	}
+
+	for _, p := range pkgs {
+		schedule(p)
+	}
+	for _, ch := range done {
+		<-ch
+	}
+}
+
+// parallel calls fn(i) for each i in [0, n) using up to j goroutines.
+func parallel(n, j int, fn func(i int)) {
+	if j < 1 {
+		j = 1
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < j && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
@@ -6,7 +6,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -70,12 +69,21 @@ type Package struct {
 	Stale      bool          // would 'go install' do anything for this package?
 	Incomplete bool          // was there an error loading this package or dependencies?
 	Error      *PackageError // error loading this package (not dependencies)
+	DepOnly    bool          // package is only a dependency, not explicitly listed
+
+	// Set only in module mode, from the output of "go list".
+	Module      *Module           // info about package's containing module, if any
+	Deps        []string          // all (recursively) imported dependencies
+	ImportMap   map[string]string // map from source import to ImportPath
+	StaleReason string            // explanation for Stale==true
 
 	imports     []*Package
 	deps        []*Package
 	local       bool // imported via local path (./ or ../)
 	fingerprint *string
-	race        bool
+	manifest    *manifest    // inputs to fingerprint
+	options     buildOptions // build options from the package argument
+	testImports []*Package   // packages imported by the tests, if loaded
 }
 
 // A PackageError describes an error loading information about a package.
@@ -164,7 +172,7 @@ func makeImportValid(r rune) rune {
 // but possibly a local import path (an absolute file system path or one beginning
 // with ./ or ../).  A local relative path is interpreted relative to srcDir.
 // It returns a *Package describing the package found in that directory.
-func loadImport(buildContext *build.Context, path string, srcDir string,
+func loadImport(buildContext *build.Context, options buildOptions, path string, srcDir string,
 	stk *importStack, importPos []token.Position) *Package {
 	stk.push(path)
 	defer stk.pop()
@@ -178,10 +186,7 @@ func loadImport(buildContext *build.Context, path string, srcDir string,
 	if isLocal {
 		importPath = dirToImportPath(filepath.Join(srcDir, path))
 	}
-	fullImportPath := importPath
-	if contains(buildContext.BuildTags, "race") {
-		fullImportPath += ":race"
-	}
+	fullImportPath := options.importPath(importPath)
 	if p := packageCache[fullImportPath]; p != nil {
 		return reusePackage(p, stk)
 	}
@@ -205,7 +210,7 @@ func loadImport(buildContext *build.Context, path string, srcDir string,
 		err = fmt.Errorf("code in directory %s expects import %q", bp.Dir, bp.ImportComment)
 	}
 	p.baseImportPath = importPath
-	p.load(buildContext, stk, bp, err)
+	p.load(buildContext, options, stk, bp, err)
 	if p.Error != nil && len(importPos) > 0 {
 		pos := importPos[0]
 		pos.Filename = shortPath(pos.Filename)
@@ -264,6 +269,7 @@ func expandScanner(err error) error {
 var raceExclude = map[string]bool{
 	"runtime/race": true,
 	"runtime/msan": true,
+	"runtime/asan": true,
 	"runtime/cgo":  true,
 	"cmd/cgo":      true,
 	"syscall":      true,
@@ -277,16 +283,17 @@ var cgoExclude = map[string]bool{
 var cgoSyscallExclude = map[string]bool{
 	"runtime/cgo":  true,
 	"runtime/msan": true,
+	"runtime/asan": true,
 	"runtime/race": true,
 }
 
 // load populates p using information from bp, err, which should
 // be the result of calling build.Context.Import.
-func (p *Package) load(buildContext *build.Context, stk *importStack, bp *build.Package, err error) *Package {
+func (p *Package) load(buildContext *build.Context, options buildOptions, stk *importStack, bp *build.Package, err error) *Package {
 	p.Package = bp
 	p.buildContext = buildContext
 	p.Standard = p.Goroot && p.ImportPath != "" && !strings.Contains(p.ImportPath, ".")
-	p.race = contains(p.buildContext.BuildTags, "race")
+	p.options = options
 
 	if err != nil {
 		p.Incomplete = true
@@ -301,7 +308,7 @@ func (p *Package) load(buildContext *build.Context, stk *importStack, bp *build.
 	if p.Name == "main" {
 		_, elem := filepath.Split(p.Dir)
 		full := buildContext.GOOS + "_" + buildContext.GOARCH + "/" + elem
-		if buildContext.GOOS != runtime.GOOS || buildContext.GOARCH != runtime.GOARCH {
+		if buildContext.GOOS != goToolchain().GOOS || buildContext.GOARCH != goToolchain().GOARCH {
 			// Install cross-compiled binaries to subdirectories of bin.
 			elem = full
 		}
@@ -335,10 +342,11 @@ func (p *Package) load(buildContext *build.Context, stk *importStack, bp *build.
 	// subpackages, and unsafe.
 	if !p.Standard || (p.baseImportPath != "runtime" && !strings.HasPrefix(p.baseImportPath, "runtime/internal/") && p.baseImportPath != "unsafe") {
 		importPaths = append(importPaths, "runtime")
-		// When race detection enabled everything depends on runtime/race.
+		// When race detection (or msan or asan) is enabled everything
+		// depends on runtime/race (or runtime/msan or runtime/asan).
 		// Exclude certain packages to avoid circular dependencies.
-		if p.race && (!p.Standard || !raceExclude[p.baseImportPath]) {
-			importPaths = append(importPaths, "runtime/race")
+		if mode := p.options.instrument(); mode != "" && (!p.Standard || !raceExclude[p.baseImportPath]) {
+			importPaths = append(importPaths, "runtime/"+mode)
 		}
 	}
 
@@ -349,7 +357,7 @@ func (p *Package) load(buildContext *build.Context, stk *importStack, bp *build.
 		if path == "C" {
 			continue
 		}
-		p1 := loadImport(buildContext, path, p.Dir, stk, p.ImportPos[path])
+		p1 := loadImport(buildContext, options, path, p.Dir, stk, p.ImportPos[path])
 		if p1.local {
 			if !p.local && p.Error == nil {
 				p.Error = &PackageError{
@@ -409,19 +417,35 @@ func (p *Package) usesCgo() bool {
 	return len(p.CgoFiles) > 0
 }
 
+// fingerprintDeps returns the dependencies whose fingerprints are
+// included in the fingerprint of p. The standard library is covered
+// by the toolchain version unless the build options rebuild it.
+func (p *Package) fingerprintDeps() []*Package {
+	var deps []*Package
+	for _, dep := range p.deps {
+		if p.options.rebuildsStd() || !dep.Standard {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
 // Fingerprint the package returning a digest that changes if any of
-// the sources of the packages or its dependencies change.
+// the sources of the packages or its dependencies change. The inputs
+// which went into the digest are recorded in the package's manifest.
 func (p *Package) Fingerprint() string {
 	if p.fingerprint != nil {
 		return *p.fingerprint
 	}
 
-	h := sha1.New()
+	h := scheme.newFingerprintHash()
+	m := &manifest{
+		ImportPath: p.ImportPath,
+		Deps:       map[string]string{},
+		Files:      map[string]string{},
+	}
 
-	for _, dep := range p.deps {
-		if !p.race && dep.Standard {
-			continue
-		}
+	for _, dep := range p.fingerprintDeps() {
 		fp := dep.Fingerprint()
 		if fp == "" {
 			p.fingerprint = &fp
@@ -431,24 +455,34 @@ func (p *Package) Fingerprint() string {
 		if err != nil {
 			log.Fatal(err)
 		}
+		m.Deps[dep.ImportPath] = fp
 	}
 
-	// TODO(pmattis): I need to add the output of "go version", not the
-	// version/GOOS/GOARCH that build-cache was compiled with.
-	flags := stringList(
-		runtime.Version(),
-		runtime.GOOS,
-		runtime.GOARCH,
-		p.ImportPath,
-		p.CgoCFLAGS,
-		p.CgoCPPFLAGS,
-		p.CgoCXXFLAGS,
-		p.CgoLDFLAGS,
-		p.CgoPkgConfig)
-	for _, flag := range flags {
-		_, err := h.Write([]byte(flag))
-		if err != nil {
-			log.Fatal(err)
+	// Use the toolchain on PATH, as it builds for the package's
+	// platform, not the version/GOOS/GOARCH that build-cache was
+	// compiled with. Legacy fingerprints keep the latter so that they
+	// match the entries of caches saved before fingerprints were
+	// versioned.
+	var tcFlags []inputFlag
+	if scheme.version == "" {
+		tcFlags = legacyToolchainFlags()
+	} else {
+		tcFlags = p.options.targetToolchain().fingerprintFlags()
+	}
+	m.Flags = append(tcFlags,
+		inputFlag{"import path", []string{p.ImportPath}},
+		inputFlag{"module", p.moduleFlags()},
+		inputFlag{"CgoCFLAGS", p.CgoCFLAGS},
+		inputFlag{"CgoCPPFLAGS", p.CgoCPPFLAGS},
+		inputFlag{"CgoCXXFLAGS", p.CgoCXXFLAGS},
+		inputFlag{"CgoLDFLAGS", p.CgoLDFLAGS},
+		inputFlag{"CgoPkgConfig", p.CgoPkgConfig})
+	for _, flag := range m.Flags {
+		for _, v := range flag.Values {
+			_, err := h.Write([]byte(v))
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
@@ -463,24 +497,37 @@ func (p *Package) Fingerprint() string {
 		p.SwigFiles,
 		p.SwigCXXFiles,
 		p.SysoFiles)
+	// Legacy fingerprints leave out included headers so that caches
+	// saved before they were hashed remain usable.
+	if scheme.version != "" {
+		files = append(files, p.includedHeaders()...)
+	}
 	for _, file := range files {
 		_, err := h.Write([]byte(file))
 		if err != nil {
 			log.Fatal(err)
 		}
-		f, err := os.Open(filepath.Join(p.Dir, file))
+		path := file
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.Dir, file)
+		}
+		f, err := os.Open(path)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if _, err := io.Copy(h, f); err != nil {
+		fh := scheme.newHash()
+		if _, err := io.Copy(io.MultiWriter(h, fh), f); err != nil {
 			log.Fatal(err)
 		}
 		if err := f.Close(); err != nil {
 			log.Fatal(err)
 		}
+		m.Files[file] = hex.EncodeToString(fh.Sum(nil))
 	}
 
-	s := hex.EncodeToString(h.Sum(nil))
+	s := scheme.format(h.Sum(nil))
+	m.Fingerprint = s
+	p.manifest = m
 	p.fingerprint = &s
 	return *p.fingerprint
 }
@@ -488,11 +535,22 @@ func (p *Package) Fingerprint() string {
 // computeStale computes the Stale flag in the package dag that starts
 // at the named pkgs (command-line arguments).
 func computeStale(pkgs []*Package) {
+	computeStaleFrom(pkgs, topRoots(pkgs))
+}
+
+// topRoots returns the roots (GOPATH entries or GOROOT) of pkgs.
+func topRoots(pkgs []*Package) map[string]bool {
 	topRoot := map[string]bool{}
 	for _, p := range pkgs {
 		topRoot[p.Root] = true
 	}
+	return topRoot
+}
 
+// computeStaleFrom computes the Stale flag in the package dag that
+// starts at pkgs, treating the roots in topRoot as those of the
+// packages named on the command line.
+func computeStaleFrom(pkgs []*Package, topRoot map[string]bool) {
 	// packageList returns the list of packages in the dag rooted at roots
 	// as visited in a depth-first post-order traversal.
 	packageList := func(roots []*Package) []*Package {
@@ -605,7 +663,7 @@ var cwd, _ = os.Getwd()
 // in the Go command directory, as well as paths to those directories.
 func loadPackage(arg string, stk *importStack) *Package {
 	base := packageBaseImportPath(arg)
-	options := packageOptions(arg)
+	options := packageBuildOptions(arg)
 
 	// Wasn't a command; must be a package.
 	// If it is a local import path but names a standard package,
@@ -620,16 +678,21 @@ func loadPackage(arg string, stk *importStack) *Package {
 		}
 	}
 
-	buildContext := build.Default
-	if contains(options, "race") {
-		if buildContext.InstallSuffix != "" {
-			buildContext.InstallSuffix += "_"
-		}
-		buildContext.InstallSuffix += "race"
-		buildContext.BuildTags = append(buildContext.BuildTags, "race")
-	}
+	return loadImport(newBuildContext(options), options, base, cwd, stk, nil)
+}
 
-	return loadImport(&buildContext, base, cwd, stk, nil)
+// newBuildContext returns the build context for packages built with
+// options by the toolchain on PATH.
+func newBuildContext(options buildOptions) *build.Context {
+	buildContext := build.Default
+	tc := goToolchain()
+	buildContext.GOROOT = tc.GOROOT
+	buildContext.GOPATH = tc.GOPATH
+	buildContext.GOOS = tc.GOOS
+	buildContext.GOARCH = tc.GOARCH
+	buildContext.CgoEnabled = tc.CGOEnabled == "1"
+	options.apply(&buildContext)
+	return &buildContext
 }
 
 // packagesForBuild is like 'packages' but fails if any of
@@ -639,6 +702,7 @@ func packagesForBuild(args []string) []*Package {
 	if len(args) == 0 {
 		args = []string{"."}
 	}
+	args = importPaths(args)
 	var pkgs []*Package
 	var stk importStack
 	var set = make(map[string]bool)
@@ -678,8 +742,34 @@ func packagesForBuild(args []string) []*Package {
 	return pkgs
 }
 
-func loadAll(args []string) []*Package {
+// loadAll loads the packages named by args and their dependencies. If
+// tests is set, the packages imported by the tests of the named
+// packages, and their dependencies, are loaded too.
+func loadAll(args []string, tests bool) []*Package {
+	if moduleMode() {
+		all := loadModulePackages(args, tests)
+		sort.Sort(packageList(all))
+		return all
+	}
+
 	roots := packagesForBuild(args)
+	var deps []*Package
+	for _, root := range roots {
+		deps = append(deps, root.deps...)
+	}
+	if tests {
+		var stk importStack
+		var testPkgs []*Package
+		for _, root := range roots {
+			testPkgs = append(testPkgs, root.loadTestImports(&stk)...)
+		}
+		// The test imports are not named on the command line, so
+		// they must not add to the top-level roots.
+		computeStaleFrom(testPkgs, topRoots(roots))
+		for _, p := range testPkgs {
+			deps = append(append(deps, p), p.deps...)
+		}
+	}
 
 	seen := map[*Package]bool{}
 	all := []*Package{}
@@ -687,12 +777,13 @@ func loadAll(args []string) []*Package {
 		if !seen[root] {
 			seen[root] = true
 			all = append(all, root)
-			for _, dep := range root.deps {
-				if !seen[dep] {
-					seen[dep] = true
-					all = append(all, dep)
-				}
-			}
+		}
+	}
+	for _, dep := range deps {
+		if !seen[dep] {
+			seen[dep] = true
+			dep.DepOnly = true
+			all = append(all, dep)
 		}
 	}
 
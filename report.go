@@ -0,0 +1,173 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The actions recorded for a package by save and restore.
+const (
+	actionSaved    = "saved"    // save: added to the cache
+	actionCached   = "cached"   // save: already in the cache
+	actionRestored = "restored" // restore: copied from the cache
+	actionMissed   = "missed"   // restore: not in the cache
+	actionSkipped  = "skipped"  // save: not eligible; see Reason
+)
+
+// A packageRecord describes what save or restore did with a package.
+type packageRecord struct {
+	Type        string // always "package"
+	ImportPath  string
+	Fingerprint string `json:",omitempty"`
+	Target      string `json:",omitempty"`
+	Action      string
+	Reason      string  `json:",omitempty"` // why the package was skipped
+	Bytes       int64   // bytes transferred
+	Seconds     float64 // time spent transferring
+}
+
+// String returns the record in the fixed-width format save and
+// restore have always printed: the fingerprint (or "-"), a "*" if the
+// package was saved, and the import path.
+func (r *packageRecord) String() string {
+	fp, tag, where := r.Fingerprint, " ", r.Target
+	switch r.Action {
+	case actionSaved:
+		tag = "*"
+	case actionSkipped:
+		fp = "-"
+	case actionMissed:
+		fp, where = "-", r.Fingerprint+":"+r.Target
+	}
+	if where == "" {
+		return fmt.Sprintf("%-*s %s%s", scheme.width(), fp, tag, r.ImportPath)
+	}
+	return fmt.Sprintf("%-*s %s%s (%s)", scheme.width(), fp, tag, r.ImportPath, where)
+}
+
+// A summaryRecord totals the packageRecords for a run. Hits are
+// packages found in the cache: those already cached by save and those
+// restored by restore.
+type summaryRecord struct {
+	Type     string // always "summary"
+	Command  string
+	Packages int
+	Hits     int
+	Misses   int
+	Skipped  int
+	Stale    int // skipped because the installed package is stale
+	Bytes    int64
+	Seconds  float64
+	HitRate  float64
+}
+
+// A reporter prints the outcome of save and restore, either as log
+// lines or as one JSON record per line on stdout. Packages are handled
+// in parallel, so the log lines are held until the run finishes and
+// then printed sorted by import path; JSON records are printed as they
+// come.
+type reporter struct {
+	mu      sync.Mutex
+	json    bool
+	enc     *json.Encoder
+	start   time.Time
+	summary summaryRecord
+	records []packageRecord // held for printing by finish
+	missed  []string        // import paths of the packages not in the cache
+}
+
+func newReporter(command string, jsonOutput bool) *reporter {
+	return &reporter{
+		json:    jsonOutput,
+		enc:     json.NewEncoder(os.Stdout),
+		start:   time.Now(),
+		summary: summaryRecord{Type: "summary", Command: command},
+	}
+}
+
+// record reports r, which took the time since start. It is safe to
+// call from multiple goroutines.
+func (rep *reporter) record(r packageRecord, start time.Time) {
+	r.Type = "package"
+	r.Seconds = time.Since(start).Seconds()
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	sum := &rep.summary
+	sum.Packages++
+	sum.Bytes += r.Bytes
+	switch r.Action {
+	case actionCached, actionRestored:
+		sum.Hits++
+	case actionSaved, actionMissed:
+		sum.Misses++
+		rep.missed = append(rep.missed, r.ImportPath)
+	case actionSkipped:
+		sum.Skipped++
+		if r.Reason == "stale" {
+			sum.Stale++
+		}
+	}
+
+	if rep.json {
+		if err := rep.enc.Encode(r); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	rep.records = append(rep.records, r)
+}
+
+// finish reports the summary of the run and appends it to the stats
+// log in s.
+func (rep *reporter) finish(s Store) {
+	sort.Slice(rep.records, func(i, j int) bool {
+		a, b := rep.records[i], rep.records[j]
+		if a.ImportPath != b.ImportPath {
+			return a.ImportPath < b.ImportPath
+		}
+		return a.Target < b.Target
+	})
+	for _, r := range rep.records {
+		log.Print(r.String())
+	}
+	sort.Strings(rep.missed)
+
+	sum := &rep.summary
+	sum.Seconds = time.Since(rep.start).Seconds()
+	if n := sum.Hits + sum.Misses; n > 0 {
+		sum.HitRate = float64(sum.Hits) / float64(n)
+	}
+	if err := appendStats(s, rep); err != nil {
+		log.Printf("unable to record stats: %s", err)
+	}
+	if rep.json {
+		if err := rep.enc.Encode(sum); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	log.Printf("%d packages: %d hits, %d misses, %d skipped (%.0f%% hit rate), %s in %.1fs",
+		sum.Packages, sum.Hits, sum.Misses, sum.Skipped, 100*sum.HitRate, formatSize(sum.Bytes), sum.Seconds)
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReporterSorted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	paths := []string{"c", "a/b", "b", "a", "a/c"}
+	rep := newReporter("restore", false)
+	parallel(len(paths), len(paths), func(i int) {
+		rep.record(packageRecord{ImportPath: paths[i], Action: actionMissed}, time.Now())
+	})
+	if buf.Len() != 0 {
+		t.Fatalf("records were printed before finish:\n%s", buf.String())
+	}
+	rep.finish(newDirStore(tmp))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if summary := lines[len(lines)-1]; !strings.HasPrefix(summary, "5 packages:") {
+		t.Errorf("summary is %q", summary)
+	}
+	var got []string
+	for _, line := range lines[:len(lines)-1] {
+		got = append(got, strings.Fields(line)[1])
+	}
+	want := []string{"a", "a/b", "a/c", "b", "c"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
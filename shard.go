@@ -0,0 +1,179 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A dirStore keeps each entry in a subdirectory named by the first
+// shardLen characters of its key, so that no directory grows to
+// hundreds of thousands of files. Sidecars share the prefix of their
+// entry and so its subdirectory. The toolchain and stats entries stay
+// at the top of the cache directory, which is also where every entry was kept
+// before the cache was sharded. Entries are still read from that flat
+// layout until the migrate command moves them.
+const shardLen = 2
+
+// path returns the file for the entry for key. The version a
+// fingerprint begins with is skipped when choosing the shard.
+func (s *dirStore) path(key string) string {
+	return shardPath(s.dir, key)
+}
+
+// shardPath returns the file for key in the sharded layout under dir.
+func shardPath(dir, key string) string {
+	digest := trimVersion(key)
+	if len(digest) <= shardLen || bookkeepingKeys[key] {
+		return filepath.Join(dir, key)
+	}
+	return filepath.Join(dir, digest[:shardLen], key)
+}
+
+// flatPath returns the file for the entry for key in the flat layout.
+func (s *dirStore) flatPath(key string) string {
+	return filepath.Join(s.dir, key)
+}
+
+// find returns the file holding the entry for key, which is in the
+// flat layout if it has not been migrated.
+func (s *dirStore) find(key string) string {
+	path := s.path(key)
+	if flat := s.flatPath(key); flat != path && !exists(path) && exists(flat) {
+		return flat
+	}
+	return path
+}
+
+// isShard returns true if fi is a shard subdirectory.
+func isShard(fi os.FileInfo) bool {
+	return fi.IsDir() && len(fi.Name()) == shardLen && validKey(fi.Name())
+}
+
+// walk calls fn for each entry in the store, in either layout, with
+// its key, file and FileInfo.
+func (s *dirStore) walk(fn func(key, path string, fi os.FileInfo) error) error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range infos {
+		path := filepath.Join(s.dir, fi.Name())
+		if isShard(fi) {
+			shard, err := ioutil.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for _, sfi := range shard {
+				if !sfi.Mode().IsRegular() || !validKey(sfi.Name()) {
+					continue
+				}
+				if err := fn(sfi.Name(), filepath.Join(path, sfi.Name()), sfi); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() || !validKey(fi.Name()) {
+			continue
+		}
+		if err := fn(fi.Name(), path, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveStaleTemp removes the stale temporary files from the cache
+// directory and its shards.
+func (s *dirStore) RemoveStaleTemp() error {
+	if err := removeStaleTemp(s.dir); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if isShard(fi) {
+			if err := removeStaleTemp(filepath.Join(s.dir, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrate moves the entries in the flat layout into their shards and
+// returns the number moved.
+func (s *dirStore) migrate() (int, error) {
+	var flat []string
+	err := s.walk(func(key, path string, fi os.FileInfo) error {
+		if path == s.flatPath(key) && path != s.path(key) {
+			flat = append(flat, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range flat {
+		if err := os.MkdirAll(filepath.Dir(s.path(key)), 0755); err != nil {
+			return i, err
+		}
+		// An entry saved again since sharding is already in place.
+		if exists(s.path(key)) {
+			if err := os.Remove(s.flatPath(key)); err != nil {
+				return i, err
+			}
+			continue
+		}
+		if err := os.Rename(s.flatPath(key), s.path(key)); err != nil {
+			return i, err
+		}
+	}
+	return len(flat), nil
+}
+
+// migrateCache converts a cache directory in the flat layout to the
+// sharded one in place.
+func migrateCache(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	s, err := openStore(cacheLocation())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ds, ok := s.(*dirStore)
+	if !ok {
+		log.Fatalf("%s is not a local cache directory", s)
+	}
+	defer lockStore(ds, true)()
+	log.Printf("migrating %s", ds)
+	n, err := ds.migrate()
+	log.Printf("moved %d entries into shards", n)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMigrate checks that a cache in the flat layout can be read
+// before and after it is migrated to shards, and that deleting an
+// entry from either layout removes its sidecars.
+func TestMigrate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "cache")
+	ds := newDirStore(dir)
+	s, err := newCompressStore(newChecksumStore(ds), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]string{
+		"v2-abcd":                   "first",
+		"v2-cdef":                   "second",
+		manifestKey("v2-abcd"):      "manifest",
+		toolchainFile:               "{}",
+		historyKey("example.com/a"): "{}\n",
+	}
+	for key, body := range entries {
+		if err := putBytes(s, key, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Append(statsFile, []byte("{}\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move everything back to the top of the cache directory, as it
+	// was kept before sharding.
+	var files []string
+	err = ds.walk(func(key, path string, fi os.FileInfo) error {
+		files = append(files, key)
+		if path != ds.flatPath(key) {
+			return os.Rename(path, ds.flatPath(key))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecars := []string{
+		checksumKey("v2-abcd"), metaKey("v2-abcd"),
+		checksumKey("v2-cdef"), metaKey("v2-cdef"),
+	}
+	for _, key := range sidecars {
+		if !exists(ds.flatPath(key)) {
+			t.Fatalf("%s was not written", key)
+		}
+	}
+
+	check := func(layout string) {
+		for key, body := range entries {
+			b, err := getBytes(s, key)
+			if err != nil {
+				t.Errorf("%s: %s: %s", layout, key, err)
+				continue
+			}
+			if string(b) != body {
+				t.Errorf("%s: %s = %q, want %q", layout, key, b, body)
+			}
+		}
+	}
+	check("flat")
+
+	n, err := ds.migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything but the toolchain and stats moves.
+	if want := len(files) - 2; n != want {
+		t.Errorf("migrated %d entries, want %d", n, want)
+	}
+	for _, key := range files {
+		want := filepath.Join(dir, trimVersion(key)[:shardLen], key)
+		if bookkeepingKeys[key] {
+			want = filepath.Join(dir, key)
+		}
+		if !exists(want) {
+			t.Errorf("%s is not at %s", key, want)
+		}
+	}
+	check("sharded")
+
+	// Delete an entry from each layout.
+	flat := ds.path("v2-cdef")
+	if err := os.Rename(flat, ds.flatPath("v2-cdef")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"v2-abcd", "v2-cdef"} {
+		if err := s.Delete(key); err != nil {
+			t.Errorf("delete %s: %s", key, err)
+		}
+		for _, k := range []string{key, checksumKey(key), metaKey(key)} {
+			if exists(ds.path(k)) || exists(ds.flatPath(k)) {
+				t.Errorf("%s remains after deleting %s", k, key)
+			}
+		}
+	}
+	if !exists(ds.path(manifestKey("v2-abcd"))) {
+		t.Errorf("manifest was removed with its entry")
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// statsFile is the store entry holding the stats log: one JSON
+// statsRecord per line, appended by each run of save and restore.
+const statsFile = "stats.jsonl"
+
+// maxStatsSize bounds the size of the stats log. Eviction never
+// removes it, so once it grows past this size its oldest records are
+// dropped, keeping the newest half.
+const maxStatsSize = 1 << 20
+
+// maxStatsMissed bounds the number of missed packages recorded for a
+// run, which keeps the records of runs with a cold cache small. Runs
+// which miss more record a random sample of them; Misses still counts
+// them all.
+const maxStatsMissed = 20
+
+// estimatedBuildRate is the rate, in bytes of installed output per
+// second, at which packages are assumed to build. It is only used to
+// estimate the build time restoring a package saves.
+const estimatedBuildRate = 2 << 20
+
+// A statsRecord holds the counters for a run of save or restore.
+type statsRecord struct {
+	Time         time.Time
+	Command      string
+	Host         string `json:",omitempty"`
+	Packages     int
+	Hits         int
+	Misses       int
+	Stale        int
+	Bytes        int64    // bytes saved or restored
+	Seconds      float64  // duration of the run
+	SavedSeconds float64  `json:",omitempty"` // estimated build time avoided by restoring
+	Missed       []string `json:",omitempty"` // import paths of (a sample of) the packages missed
+}
+
+// An appender is a Store which can append to an entry in place.
+type appender interface {
+	Append(key string, b []byte, limit int64) error
+}
+
+// appendBytes appends the lines b to the entry for key, creating it if
+// it does not exist. If the entry would grow larger than limit, its
+// oldest lines are dropped, keeping the newest limit/2 bytes. Stores
+// which cannot append in place (such as the HTTP store) rewrite the
+// whole entry, so concurrent appends are last-writer-wins: all but one
+// of them may be lost.
+func appendBytes(s Store, key string, b []byte, limit int64) error {
+	if a, ok := s.(appender); ok {
+		return a.Append(key, b, limit)
+	}
+	old, err := getBytes(s, key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return putBytes(s, key, trimLines(append(old, b...), limit))
+}
+
+// trimLines returns b if it is no larger than limit, and otherwise the
+// newest whole lines of b which fit in limit/2 bytes.
+func trimLines(b []byte, limit int64) []byte {
+	if int64(len(b)) <= limit {
+		return b
+	}
+	tail := b[int64(len(b))-limit/2:]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+		return tail[i+1:]
+	}
+	return nil
+}
+
+func (s *dirStore) Append(key string, b []byte, limit int64) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	unlock, err := s.lockEntry(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(b)) > limit {
+		old, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return writeAtomic(path, 0644, bytes.NewReader(trimLines(append(old, b...), limit)))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *checksumStore) Append(key string, b []byte, limit int64) error {
+	return appendBytes(s.Store, key, b, limit)
+}
+
+func (s *compressStore) Append(key string, b []byte, limit int64) error {
+	return appendBytes(s.Store, key, b, limit)
+}
+
+// appendStats appends the counters for the run reported by rep to the
+// stats log in s.
+func appendStats(s Store, rep *reporter) error {
+	sum := rep.summary
+	r := statsRecord{
+		Time:     time.Now().UTC(),
+		Command:  sum.Command,
+		Packages: sum.Packages,
+		Hits:     sum.Hits,
+		Misses:   sum.Misses,
+		Stale:    sum.Stale,
+		Bytes:    sum.Bytes,
+		Seconds:  sum.Seconds,
+		Missed:   append([]string(nil), rep.missed...),
+	}
+	r.Host, _ = os.Hostname()
+	if r.Command == "restore" {
+		r.SavedSeconds = float64(sum.Bytes) / estimatedBuildRate
+	}
+	if len(r.Missed) > maxStatsMissed {
+		rand.Shuffle(len(r.Missed), func(i, j int) {
+			r.Missed[i], r.Missed[j] = r.Missed[j], r.Missed[i]
+		})
+		r.Missed = r.Missed[:maxStatsMissed]
+	}
+	sort.Strings(r.Missed)
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return appendBytes(s, statsFile, append(b, '\n'), maxStatsSize)
+}
+
+// readStats returns the records in the stats log in s.
+func readStats(s Store) ([]statsRecord, error) {
+	b, err := getBytes(s, statsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []statsRecord
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r statsRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			// A run killed while appending leaves a partial line.
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// stats summarizes the stats log and the contents of the cache.
+func stats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	since := flags.String("since", "7d", "only summarize runs within this age")
+	top := flags.Int("top", 10, "number of most missed packages to show")
+	_ = flags.Parse(args)
+
+	age, err := parseAge(*since)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cutoff := time.Now().Add(-age)
+
+	s := openCache()
+	defer lockStore(s, false)()
+	records, err := readStats(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("stats for %s over the last %s", s, *since)
+
+	type totals struct {
+		runs, packages, hits, misses, stale int
+		bytes                               int64
+		savedSeconds                        float64
+	}
+	byCommand := map[string]*totals{}
+	missed := map[string]float64{} // estimated number of runs missing each package
+	for _, r := range records {
+		if r.Time.Before(cutoff) {
+			continue
+		}
+		t := byCommand[r.Command]
+		if t == nil {
+			t = &totals{}
+			byCommand[r.Command] = t
+		}
+		t.runs++
+		t.packages += r.Packages
+		t.hits += r.Hits
+		t.misses += r.Misses
+		t.stale += r.Stale
+		t.bytes += r.Bytes
+		t.savedSeconds += r.SavedSeconds
+		if r.Command == "restore" {
+			// A run which missed more packages than it recorded
+			// stands for the ones left out of its sample.
+			weight := 1.0
+			if r.Misses > len(r.Missed) && len(r.Missed) > 0 {
+				weight = float64(r.Misses) / float64(len(r.Missed))
+			}
+			for _, path := range r.Missed {
+				missed[path] += weight
+			}
+		}
+	}
+
+	hitRate := func(t *totals) float64 {
+		if n := t.hits + t.misses; n > 0 {
+			return 100 * float64(t.hits) / float64(n)
+		}
+		return 0
+	}
+	if t := byCommand["restore"]; t != nil {
+		log.Printf("restore: %d runs, %d packages, %.0f%% hit rate, %s restored, ~%s of building saved",
+			t.runs, t.packages, hitRate(t), formatSize(t.bytes),
+			time.Duration(t.savedSeconds*float64(time.Second)).Round(time.Second))
+	}
+	if t := byCommand["save"]; t != nil {
+		log.Printf("save: %d runs, %d packages, %.0f%% hit rate, %s saved, %d stale",
+			t.runs, t.packages, hitRate(t), formatSize(t.bytes), t.stale)
+	}
+	if len(byCommand) == 0 {
+		log.Printf("no runs recorded")
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var count int
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+		if compressible(e.Key) {
+			count++
+		}
+	}
+	log.Printf("cache: %d entries, %s", count, formatSize(size))
+
+	if len(missed) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(missed))
+	for path := range missed {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if missed[paths[i]] != missed[paths[j]] {
+			return missed[paths[i]] > missed[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) > *top {
+		paths = paths[:*top]
+	}
+	log.Printf("most missed by restore:")
+	for _, path := range paths {
+		log.Printf("%6.0f  %s", missed[path], path)
+	}
+}
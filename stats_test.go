@@ -0,0 +1,119 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrimLines(t *testing.T) {
+	testCases := []struct {
+		in    string
+		limit int64
+		want  string
+	}{
+		{"", 10, ""},
+		{"a\nb\n", 10, "a\nb\n"},
+		{"aaaa\nbbbb\ncccc\n", 15, "aaaa\nbbbb\ncccc\n"},
+		{"aaaa\nbbbb\ncccc\n", 14, "cccc\n"},
+		{"aaaa\nbbbb\ncccc\n", 4, ""},
+		{"aaaaaaaaaa\n", 4, ""},
+	}
+	for _, c := range testCases {
+		if got := string(trimLines([]byte(c.in), c.limit)); got != c.want {
+			t.Errorf("trimLines(%q, %d) = %q, want %q", c.in, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestAppendLimit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const limit = 100
+	s := newDirStore(tmp)
+	var last string
+	for i := 0; i < 50; i++ {
+		last = fmt.Sprintf("record %02d\n", i)
+		if err := appendBytes(s, statsFile, []byte(last), limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmp, statsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > limit {
+		t.Errorf("stats log is %d bytes, limit %d", len(b), limit)
+	}
+	if !strings.HasSuffix(string(b), last) {
+		t.Errorf("stats log lost the newest record:\n%s", b)
+	}
+}
+
+// TestAppendStatsMissedSample checks that a run missing more packages
+// than are recorded records a sample drawn from all of them rather
+// than the alphabetically first ones.
+func TestAppendStatsMissedSample(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	s := newDirStore(tmp)
+
+	const n = 10 * maxStatsMissed
+	const runs = 20
+	for i := 0; i < runs; i++ {
+		rep := newReporter("restore", false)
+		for j := 0; j < n; j++ {
+			rep.missed = append(rep.missed, fmt.Sprintf("p%03d", j))
+		}
+		rep.summary.Misses = n
+		if err := appendStats(s, rep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := readStats(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != runs {
+		t.Fatalf("%d records, want %d", len(records), runs)
+	}
+	seen := map[string]bool{}
+	for _, r := range records {
+		if len(r.Missed) != maxStatsMissed || r.Misses != n {
+			t.Fatalf("record has %d of %d missed packages, want %d of %d", len(r.Missed), r.Misses, maxStatsMissed, n)
+		}
+		for _, path := range r.Missed {
+			seen[path] = true
+		}
+	}
+	// The first maxStatsMissed paths alone would be all of a biased
+	// sample; random samples cover far more of them.
+	if len(seen) <= 2*maxStatsMissed {
+		t.Errorf("the samples cover only %d of %d missed packages", len(seen), n)
+	}
+}
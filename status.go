@@ -0,0 +1,123 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// statusMissExitCode is the exit code of the status command when the
+// cache is missing some of the packages. Exit code 1 is reserved for
+// errors.
+const statusMissExitCode = 2
+
+// status reports what restore and save would do for each package
+// without modifying the cache or the installed packages.
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	gocache := flags.Bool("gocache", false, "check for the go command's GOCACHE entries instead of installed packages")
+	j := flags.Int("j", runtime.NumCPU(), "number of packages to fingerprint in parallel")
+	platform := flags.String("platform", "", "cross-compile for this GOOS/GOARCH (e.g. linux/arm64)")
+	_ = flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	args = withPlatform(args, *platform)
+
+	// Open the underlying store: status only checks which entries
+	// exist and reads the toolchain, both of which it can do in place
+	// without marking anything as used.
+	s, err := openStore(cacheLocation())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("checking %s against %s", args, s)
+
+	tc := goToolchain()
+	log.Printf("toolchain: %s", tc)
+	// Locking a cache directory creates it, so a missing one is
+	// reported as empty instead.
+	if ds, ok := s.(*dirStore); ok && !exists(ds.dir) {
+		log.Printf("%s does not exist", ds.dir)
+	} else {
+		defer lockStore(s, false)()
+		checkToolchain(s, tc)
+	}
+
+	start := time.Now()
+	pkgs := loadAll(args, false)
+	log.Printf("finished loading: %s", time.Since(start))
+
+	if !*gocache {
+		pkgs = packagesToCache(pkgs)
+	}
+	fingerprintAll(pkgs, *j)
+
+	var total, hits, stale, saves int
+	for _, pkg := range pkgs {
+		if *gocache && !hasGocacheOutput(pkg) {
+			log.Printf("%-*s  %-4s %-7s %s", scheme.width(), "-", "skip", "", pkg.ImportPath)
+			continue
+		}
+		total++
+
+		fp := pkg.Fingerprint()
+		key := fp
+		if *gocache {
+			key = gocacheKey(fp)
+		}
+		ok, err := s.Has(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cached := "miss"
+		if ok {
+			cached = "hit"
+			hits++
+		}
+
+		// The state of the installed package only matters when saving
+		// installed packages.
+		local := ""
+		if !*gocache {
+			switch {
+			case pkg.Stale:
+				local = "stale"
+				stale++
+			case !exists(pkg.Target):
+				local = "missing"
+			default:
+				local = "ok"
+				if !ok {
+					local = "save"
+					saves++
+				}
+			}
+		}
+		log.Printf("%-*s  %-4s %-7s %s (%s)", scheme.width(), fp, cached, local, pkg.ImportPath, pkg.Target)
+	}
+
+	log.Printf("%d packages: %d hits, %d misses, %d stale, %d would be saved",
+		total, hits, total-hits, stale, saves)
+	if hits < total {
+		os.Exit(statusMissExitCode)
+	}
+}
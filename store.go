@@ -0,0 +1,379 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Entry describes a single entry in a Store.
+type Entry struct {
+	Key     string
+	Size    int64
+	ModTime time.Time // when the entry was last written or restored
+}
+
+// A Store holds cache entries keyed by name (usually a package
+// fingerprint). Errors for missing entries satisfy os.IsNotExist.
+type Store interface {
+	// Has returns true if the store contains an entry for key.
+	Has(key string) (bool, error)
+	// Get copies the entry for key to the local file dst, recording
+	// the access for eviction.
+	Get(key, dst string) error
+	// Put copies the local file src into the entry for key.
+	Put(key, src string) error
+	// Delete removes the entry for key.
+	Delete(key string) error
+	// List returns all of the entries in the store.
+	List() ([]Entry, error)
+	// Stat returns the entry for key.
+	Stat(key string) (Entry, error)
+	// String returns the location of the store.
+	String() string
+}
+
+// An opener is a Store which can read an entry in place. Reading an
+// entry this way neither copies it nor counts as a use of it.
+type opener interface {
+	Open(key string) (io.ReadCloser, error)
+}
+
+// storeSchemes maps a URL scheme to the constructor for the Store
+// backend which handles it.
+var storeSchemes = map[string]func(u *url.URL) (Store, error){
+	"file": func(u *url.URL) (Store, error) {
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid cache location %q: no path", u)
+		}
+		return newDirStore(u.Path), nil
+	},
+	"http":  newHTTPStore,
+	"https": newHTTPStore,
+}
+
+// cacheLocation returns the location of the cache, which is either a
+// directory or a URL.
+func cacheLocation() string {
+	d := os.Getenv("CACHE")
+	if d == "" {
+		d = os.ExpandEnv("${HOME}/buildcache")
+	}
+	return d
+}
+
+// openStore returns the Store for the cache location loc. A location
+// without a scheme is a local directory.
+func openStore(loc string) (Store, error) {
+	if !strings.Contains(loc, "://") {
+		return newDirStore(loc), nil
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := storeSchemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cache location %q", loc)
+	}
+	return fn(u)
+}
+
+// dirStore is a Store which keeps each entry in a file named by its
+// key in a local directory.
+type dirStore struct {
+	dir       string
+	cleanOnce sync.Once
+}
+
+func newDirStore(dir string) *dirStore {
+	return &dirStore{dir: dir}
+}
+
+func (s *dirStore) Has(key string) (bool, error) {
+	return exists(s.find(key)), nil
+}
+
+func (s *dirStore) Get(key, dst string) error {
+	src := s.find(key)
+	if err := s.touch(key); err != nil {
+		return err
+	}
+	return linkOrCopy(src, dst)
+}
+
+// Open opens the entry for key for reading without touching it.
+func (s *dirStore) Open(key string) (io.ReadCloser, error) {
+	return os.Open(s.find(key))
+}
+
+// touch records an access of the entry for key. The modification
+// time of an entry is the time it was last used, which is what
+// eviction orders entries by.
+func (s *dirStore) touch(key string) error {
+	now := time.Now()
+	return os.Chtimes(s.find(key), now, now)
+}
+
+// mkdirFor creates the directory the entry for key is written to.
+func (s *dirStore) mkdirFor(key string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(key)), 0755); err != nil {
+		return err
+	}
+	s.cleanOnce.Do(func() {
+		if err := s.RemoveStaleTemp(); err != nil {
+			log.Printf("unable to remove temporary files: %s", err)
+		}
+	})
+	return nil
+}
+
+func (s *dirStore) Put(key, src string) error {
+	if err := s.mkdirFor(key); err != nil {
+		return err
+	}
+	unlock, err := s.lockEntry(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return linkOrCopy(src, s.path(key))
+}
+
+// Delete removes the entry for key from both layouts.
+func (s *dirStore) Delete(key string) error {
+	unlock, err := s.lockEntry(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(s.path(key))
+	if flat := s.flatPath(key); flat != s.path(key) {
+		if ferr := os.Remove(flat); err != nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+func (s *dirStore) List() ([]Entry, error) {
+	var entries []Entry
+	err := s.walk(func(key, path string, fi os.FileInfo) error {
+		entries = append(entries, Entry{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return entries, err
+}
+
+func (s *dirStore) Stat(key string) (Entry, error) {
+	fi, err := os.Stat(s.find(key))
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *dirStore) String() string {
+	return s.dir
+}
+
+// tempPrefix begins the names of the temporary files written by
+// writeAtomic. Such files are not valid keys, so stores never list
+// them.
+const tempPrefix = ".tmp-"
+
+// staleTempAge is the age after which a temporary file is assumed to
+// have been left behind by a process which crashed or was killed.
+const staleTempAge = time.Hour
+
+// writeAtomic creates dst with the contents of r. The contents are
+// written to a temporary file in the same directory, synced to disk and
+// then renamed into place, so a crash never leaves a partial dst. The
+// directory is synced too, so that the rename itself survives a crash.
+func writeAtomic(dst string, perm os.FileMode, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(dst), tempPrefix+filepath.Base(dst)+"-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// removeStaleTemp removes the temporary files in dir which were left
+// behind by writeAtomic in processes that did not finish. Recent files
+// may belong to a write in progress and are kept.
+func removeStaleTemp(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cutoff := time.Now().Add(-staleTempAge)
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), tempPrefix) && fi.ModTime().Before(cutoff) {
+			if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A tempRemover is a Store which can remove the temporary files left
+// behind by writes which did not finish.
+type tempRemover interface {
+	RemoveStaleTemp() error
+}
+
+// removeStoreTemp removes the stale temporary files from s, if it
+// keeps any. Stores only do so on their own when an entry is put.
+func removeStoreTemp(s Store) {
+	r, ok := s.(tempRemover)
+	if !ok {
+		return
+	}
+	if err := r.RemoveStaleTemp(); err != nil {
+		log.Printf("unable to remove temporary files: %s", err)
+	}
+}
+
+func (s *checksumStore) RemoveStaleTemp() error {
+	if r, ok := s.Store.(tempRemover); ok {
+		return r.RemoveStaleTemp()
+	}
+	return nil
+}
+
+func (s *compressStore) RemoveStaleTemp() error {
+	if r, ok := s.Store.(tempRemover); ok {
+		return r.RemoveStaleTemp()
+	}
+	return nil
+}
+
+// putBytes stores b as the entry for key.
+func putBytes(s Store, key string, b []byte) error {
+	f, err := ioutil.TempFile("", "build-cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_ = s.Delete(key)
+	return s.Put(key, f.Name())
+}
+
+// openEntry opens the entry for key for reading, in place if s is an
+// opener. Otherwise the entry is copied to a temporary file, which is
+// removed when it is closed.
+func openEntry(s Store, key string) (io.ReadCloser, error) {
+	if o, ok := s.(opener); ok {
+		return o.Open(key)
+	}
+	dir, err := ioutil.TempDir("", "build-cache")
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(dir, key)
+	if err := s.Get(key, tmp); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return &tempFile{File: f, dir: dir}, nil
+}
+
+// A tempFile is a file in a temporary directory which is removed when
+// the file is closed.
+type tempFile struct {
+	*os.File
+	dir string
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	_ = os.RemoveAll(f.dir)
+	return err
+}
+
+// readBytes returns the contents of the entry for key, read in place
+// where s allows so that reading does not count as a use.
+func readBytes(s Store, key string) ([]byte, error) {
+	r, err := openEntry(s, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// getBytes returns the contents of the entry for key.
+func getBytes(s Store, key string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "build-cache")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, key)
+	if err := s.Get(key, tmp); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(tmp)
+}
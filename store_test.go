@@ -0,0 +1,99 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleTemp(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "cache")
+	writeFiles(t, dir, map[string]string{
+		"ab/v2-abcd":             "entry",
+		".tmp-v2-1234-1":         "stale",
+		"ab/.tmp-v2-abcd-1":      "stale",
+		"ab/.tmp-v2-abcd-2":      "recent",
+		"quarantine/.tmp-v2-1-1": "not a shard",
+	})
+	old := time.Now().Add(-2 * staleTempAge)
+	for _, name := range []string{".tmp-v2-1234-1", "ab/.tmp-v2-abcd-1", "quarantine/.tmp-v2-1-1"} {
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(name)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newCompressStore(newChecksumStore(newDirStore(dir)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeStoreTemp(s)
+
+	testCases := []struct {
+		name string
+		want bool
+	}{
+		{"ab/v2-abcd", true},
+		{".tmp-v2-1234-1", false},
+		{"ab/.tmp-v2-abcd-1", false},
+		{"ab/.tmp-v2-abcd-2", true},
+		{"quarantine/.tmp-v2-1-1", true},
+	}
+	for _, c := range testCases {
+		if got := exists(filepath.Join(dir, filepath.FromSlash(c.name))); got != c.want {
+			t.Errorf("%s exists = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "v2-abcd")
+	for _, contents := range []string{"one", "two"} {
+		if err := writeAtomic(path, 0644, strings.NewReader(contents)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != contents {
+			t.Errorf("contents = %q, want %q", b, contents)
+		}
+	}
+	infos, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("%d files left in %s, want 1", len(infos), tmp)
+	}
+}
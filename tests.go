@@ -0,0 +1,247 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With -tests, save and restore also handle the packages imported by
+// the tests of the packages named on the command line. Those packages
+// are loaded along with the regular dependencies and cached in the
+// same way. With -testbin, the test binaries built by "go test -c" are
+// cached too, under a fingerprint covering the package, its test files
+// and the packages the tests import.
+
+// isTestVariant reports whether path, as printed by "go list -test",
+// names a test binary ("p.test") or a package recompiled for a test
+// ("p [p.test]") rather than a package.
+func isTestVariant(path string) bool {
+	return strings.Contains(path, " [") || strings.HasSuffix(path, ".test")
+}
+
+// testVariantOf returns the import path of the package whose test
+// binary the test variant path belongs to: "p" for "p [p.test]" and
+// "p_test [p.test]". It returns "" for the test binary itself.
+func testVariantOf(path string) string {
+	i := strings.Index(path, " [")
+	if i == -1 || !strings.HasSuffix(path, ".test]") {
+		return ""
+	}
+	return strings.TrimSuffix(path[i+2:], ".test]")
+}
+
+// hasTests reports whether p has any test files.
+func (p *Package) hasTests() bool {
+	return len(p.TestGoFiles) > 0 || len(p.XTestGoFiles) > 0
+}
+
+// loadTestImports loads the packages imported by the tests of p, and
+// their dependencies, and returns them.
+func (p *Package) loadTestImports(stk *importStack) []*Package {
+	for _, path := range stringList(p.TestImports, p.XTestImports) {
+		if path == "C" || path == p.baseImportPath {
+			continue
+		}
+		p1 := loadImport(p.buildContext, p.options, path, p.Dir, stk, nil)
+		if p1.Error != nil {
+			log.Printf("%s: %s", p.ImportPath, p1.Error)
+			continue
+		}
+		p.testImports = append(p.testImports, p1)
+	}
+	return p.testImports
+}
+
+// TestFingerprint returns a digest of the inputs of the test binary of
+// p: the fingerprint of p, those of the packages its tests import and
+// the test files. The fingerprints of the imported packages must
+// already have been computed.
+func (p *Package) TestFingerprint() string {
+	fp := p.Fingerprint()
+	if fp == "" {
+		return ""
+	}
+	h := scheme.newFingerprintHash()
+	write := func(b []byte) {
+		if _, err := h.Write(b); err != nil {
+			log.Fatal(err)
+		}
+	}
+	write([]byte("test " + fp))
+	for _, p1 := range p.testImports {
+		if p1.Standard && !p1.options.rebuildsStd() {
+			continue
+		}
+		fp1 := p1.Fingerprint()
+		if fp1 == "" {
+			return ""
+		}
+		write([]byte(fp1))
+	}
+	for _, file := range stringList(p.TestGoFiles, p.XTestGoFiles) {
+		write([]byte(file))
+		f, err := os.Open(filepath.Join(p.Dir, file))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return scheme.format(h.Sum(nil))
+}
+
+// testBinaryName returns the name of the test binary of p in the
+// -testbin directory: its full import path, including any build
+// options, escaped so that it names a single file. Unlike the names
+// "go test -c -o dir/" chooses, these never collide.
+func testBinaryName(p *Package) string {
+	return url.PathEscape(p.ImportPath) + ".test"
+}
+
+// testPackages returns the packages named on the command line which
+// have tests.
+func testPackages(pkgs []*Package) []*Package {
+	var result []*Package
+	for _, pkg := range pkgs {
+		if !pkg.DepOnly && pkg.hasTests() {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// buildTestBinary builds the test binary of p into the file bin.
+func buildTestBinary(p *Package, bin string) error {
+	args := []string{"test", "-c", "-o", bin}
+	args = append(args, p.options.goFlags()...)
+	args = append(args, p.baseImportPath)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = p.Dir
+	cmd.Env = append(os.Environ(), p.options.goEnv()...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go %s: %s\n%s", strings.Join(args[1:], " "), err, stderr.Bytes())
+	}
+	return nil
+}
+
+// saveTestBinaries saves the test binaries of the packages in pkgs
+// named on the command line to s, building each one which is not
+// already cached into dir. Binaries are built rather than taken from
+// dir as they are so that a binary out of date with its sources is
+// never saved.
+func saveTestBinaries(s Store, pkgs []*Package, dir string, j int, rep *reporter) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	pkgs = testPackages(pkgs)
+	fingerprintAll(pkgs, j)
+	parallel(len(pkgs), j, func(i int) {
+		pkg := pkgs[i]
+		start := time.Now()
+		r := packageRecord{
+			ImportPath:  pkg.options.importPath(pkg.baseImportPath + ".test"),
+			Target:      filepath.Join(dir, testBinaryName(pkg)),
+			Fingerprint: pkg.TestFingerprint(),
+		}
+		if r.Fingerprint == "" {
+			r.Action, r.Reason = actionSkipped, "no fingerprint"
+			rep.record(r, start)
+			return
+		}
+		ok, err := s.Has(r.Fingerprint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ok {
+			r.Action = actionCached
+			rep.record(r, start)
+			return
+		}
+		if err := buildTestBinary(pkg, r.Target); err != nil {
+			log.Print(err)
+			r.Fingerprint = ""
+			r.Action, r.Reason = actionSkipped, "build failed"
+			rep.record(r, start)
+			return
+		}
+		m := packageMeta(pkg)
+		m.ImportPath += ".test"
+		m.Target = ""
+		if err := putEntry(s, r.Fingerprint, r.Target, m); err != nil {
+			log.Fatal(err)
+		}
+		r.Action = actionSaved
+		r.Bytes = fileSize(r.Target)
+		rep.record(r, start)
+	})
+}
+
+// restoreTestBinaries restores the test binaries of the packages in
+// pkgs named on the command line from s into dir.
+func restoreTestBinaries(s Store, pkgs []*Package, dir string, j int, rep *reporter) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	pkgs = testPackages(pkgs)
+	fingerprintAll(pkgs, j)
+	parallel(len(pkgs), j, func(i int) {
+		pkg := pkgs[i]
+		start := time.Now()
+		r := packageRecord{
+			ImportPath:  pkg.options.importPath(pkg.baseImportPath + ".test"),
+			Target:      filepath.Join(dir, testBinaryName(pkg)),
+			Fingerprint: pkg.TestFingerprint(),
+		}
+		if r.Fingerprint == "" {
+			r.Action = actionMissed
+			rep.record(r, start)
+			return
+		}
+		_ = os.Remove(r.Target)
+		if err := s.Get(r.Fingerprint, r.Target); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			r.Action = actionMissed
+			rep.record(r, start)
+			return
+		}
+		if err := os.Chmod(r.Target, 0755); err != nil {
+			log.Fatal(err)
+		}
+		r.Action = actionRestored
+		r.Bytes = fileSize(r.Target)
+		rep.record(r, start)
+	})
+}
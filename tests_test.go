@@ -0,0 +1,117 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates the files, keyed by slash-separated path, under
+// dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestSaveTestBinaries saves and restores the test binaries of two
+// packages with the same name whose tests share a test-only import.
+// Run it with -race: the shared import must be fingerprinted before
+// the binaries are saved in parallel.
+func TestSaveTestBinaries(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	if testing.Short() {
+		t.Skip("builds test binaries")
+	}
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	mod := filepath.Join(tmp, "mod")
+	writeFiles(t, mod, map[string]string{
+		"go.mod":         "module example.com/m\n\ngo 1.16\n",
+		"a/util/util.go": "package util\n\nfunc A() int { return 1 }\n",
+		"b/util/util.go": "package util\n\nfunc B() int { return 2 }\n",
+		"testutil/eq.go": "package testutil\n\nfunc Eq(a, b int) bool { return a == b }\n",
+		"a/util/util_test.go": "package util\n\nimport (\n\t\"testing\"\n\n\t\"example.com/m/testutil\"\n)\n\n" +
+			"func TestA(t *testing.T) {\n\tif !testutil.Eq(A(), 1) {\n\t\tt.Fatal(A())\n\t}\n}\n",
+		"b/util/util_test.go": "package util_test\n\nimport (\n\t\"testing\"\n\n\t\"example.com/m/b/util\"\n\t\"example.com/m/testutil\"\n)\n\n" +
+			"func TestB(t *testing.T) {\n\tif !testutil.Eq(util.B(), 2) {\n\t\tt.Fatal(util.B())\n\t}\n}\n",
+	})
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(mod); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOWORK", "off")
+	if !moduleMode() {
+		t.Skip("go command is not in module mode")
+	}
+
+	pkgs := loadAll([]string{"./a/util", "./b/util"}, true)
+	byPath := map[string]*Package{}
+	for _, p := range pkgs {
+		byPath[p.ImportPath] = p
+	}
+	if p := byPath["example.com/m/testutil"]; p == nil || !p.DepOnly {
+		t.Fatalf("test import example.com/m/testutil not loaded as a dependency")
+	}
+	var names []string
+	for _, path := range []string{"example.com/m/a/util", "example.com/m/b/util"} {
+		p := byPath[path]
+		if p == nil {
+			t.Fatalf("%s not loaded", path)
+		}
+		names = append(names, testBinaryName(p))
+	}
+	if names[0] == names[1] {
+		t.Fatalf("test binaries of a/util and b/util are both named %s", names[0])
+	}
+
+	s := newDirStore(filepath.Join(tmp, "cache"))
+	bin := filepath.Join(tmp, "bin")
+	saveTestBinaries(s, pkgs, bin, 4, newReporter("save", false))
+
+	restored := filepath.Join(tmp, "restored")
+	restoreTestBinaries(s, pkgs, restored, 4, newReporter("restore", false))
+	for _, name := range names {
+		path := filepath.Join(restored, name)
+		if out, err := exec.Command(path).CombinedOutput(); err != nil {
+			t.Errorf("%s: %s\n%s", name, err, out)
+		}
+	}
+}
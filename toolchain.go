@@ -0,0 +1,244 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// toolchainFile is the key of the cache entry which records the
+// toolchain that most recently saved to the cache.
+const toolchainFile = "toolchain.json"
+
+// A toolchain describes the go command found on PATH. This is the
+// toolchain that produced the installed package archives, which is
+// not necessarily the one build-cache itself was compiled with.
+type toolchain struct {
+	Version    string // e.g. "go1.5.1", from "go version"
+	Compiler   string // from "go tool compile -V=full", if available
+	GOOS       string
+	GOARCH     string
+	GOARM      string
+	GOAMD64    string
+	CGOEnabled string
+	GOROOT     string
+	GOPATH     string
+	GOMOD      string // "" unless the go command is in module mode
+	GOCACHE    string // the go command's build cache
+}
+
+var (
+	theToolchain     *toolchain
+	theToolchainOnce sync.Once
+)
+
+// goToolchain returns the toolchain for the go command on PATH,
+// running "go version" and "go env" the first time it is called.
+func goToolchain() *toolchain {
+	theToolchainOnce.Do(func() {
+		t, err := loadToolchain()
+		if err != nil {
+			log.Fatal(err)
+		}
+		theToolchain = t
+	})
+	return theToolchain
+}
+
+func goCommand(args ...string) (string, error) {
+	return goCommandEnv(nil, args...)
+}
+
+// goCommandEnv runs the go command with env added to the environment
+// and returns its output.
+func goCommandEnv(env []string, args ...string) (string, error) {
+	cmd := exec.Command("go", args...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return "", fmt.Errorf("go %s: %s", strings.Join(args, " "), ee.Stderr)
+		}
+		return "", fmt.Errorf("go %s: %s", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+func loadToolchain() (*toolchain, error) {
+	out, err := goCommand("version")
+	if err != nil {
+		return nil, err
+	}
+	// The output looks like "go version go1.5.1 linux/amd64".
+	fields := strings.Fields(out)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unable to parse \"go version\" output: %q", out)
+	}
+	t := &toolchain{Version: fields[2]}
+	if err := t.loadEnv(nil); err != nil {
+		return nil, err
+	}
+
+	// The compiler version pins down development toolchains which all
+	// report the same "go version". Not every toolchain (e.g. gccgo)
+	// provides it.
+	if out, err := goCommand("tool", "compile", "-V=full"); err == nil {
+		t.Compiler = strings.TrimSpace(out)
+	}
+	return t, nil
+}
+
+// loadEnv sets the variables of t from "go env", run with env added to
+// the environment.
+func (t *toolchain) loadEnv(env []string) error {
+	// Parse the JSON form of "go env": variables may be empty (GOMOD
+	// outside module mode, GOARM off arm), which makes counting lines
+	// of the plain form unreliable.
+	vars := map[string]*string{
+		"GOOS":        &t.GOOS,
+		"GOARCH":      &t.GOARCH,
+		"GOARM":       &t.GOARM,
+		"GOAMD64":     &t.GOAMD64,
+		"CGO_ENABLED": &t.CGOEnabled,
+		"GOROOT":      &t.GOROOT,
+		"GOPATH":      &t.GOPATH,
+		"GOMOD":       &t.GOMOD,
+		"GOCACHE":     &t.GOCACHE,
+	}
+	args := []string{"env", "-json"}
+	for name := range vars {
+		args = append(args, name)
+	}
+	out, err := goCommandEnv(env, args...)
+	if err != nil {
+		return err
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal([]byte(out), &values); err != nil {
+		return fmt.Errorf("unable to parse \"go env\" output: %s", err)
+	}
+	for name, v := range vars {
+		*v = values[name]
+	}
+	return nil
+}
+
+var targetToolchains = struct {
+	sync.Mutex
+	m map[string]*toolchain
+}{m: map[string]*toolchain{}}
+
+// targetToolchain returns the toolchain as it builds for the platform
+// selected by o. Cross-compiling changes more than GOOS and GOARCH: the
+// go command picks the GOARM or GOAMD64 level and whether cgo is
+// enabled for the target, and those go into fingerprints too.
+func (o buildOptions) targetToolchain() *toolchain {
+	tc := goToolchain()
+	if !o.crossCompiles() {
+		return tc
+	}
+	targetToolchains.Lock()
+	defer targetToolchains.Unlock()
+	key := o.GOOS + "/" + o.GOARCH
+	if t := targetToolchains.m[key]; t != nil {
+		return t
+	}
+	t := *tc
+	if err := t.loadEnv(o.goEnv()); err != nil {
+		log.Fatal(err)
+	}
+	targetToolchains.m[key] = &t
+	return &t
+}
+
+// fingerprintFlags returns the toolchain facts which are included in
+// every package fingerprint.
+func (t *toolchain) fingerprintFlags() []inputFlag {
+	return []inputFlag{
+		{"go version", []string{t.Version}},
+		{"compiler", []string{t.Compiler}},
+		{"GOOS", []string{t.GOOS}},
+		{"GOARCH", []string{t.GOARCH}},
+		{"GOARM", []string{t.GOARM}},
+		{"GOAMD64", []string{t.GOAMD64}},
+		{"CGO_ENABLED", []string{t.CGOEnabled}},
+	}
+}
+
+func (t *toolchain) String() string {
+	s := fmt.Sprintf("%s %s/%s", t.Version, t.GOOS, t.GOARCH)
+	if t.GOARM != "" {
+		s += " GOARM=" + t.GOARM
+	}
+	if t.GOAMD64 != "" {
+		s += " GOAMD64=" + t.GOAMD64
+	}
+	return s + " CGO_ENABLED=" + t.CGOEnabled
+}
+
+// mismatch returns a description of the differences between t and o
+// which affect fingerprints, or "" if there are none.
+func (t *toolchain) mismatch(o *toolchain) string {
+	var diffs []string
+	check := func(name, a, b string) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s %q != %q", name, a, b))
+		}
+	}
+	check("version", t.Version, o.Version)
+	check("compiler", t.Compiler, o.Compiler)
+	check("GOOS", t.GOOS, o.GOOS)
+	check("GOARCH", t.GOARCH, o.GOARCH)
+	check("GOARM", t.GOARM, o.GOARM)
+	check("GOAMD64", t.GOAMD64, o.GOAMD64)
+	check("CGO_ENABLED", t.CGOEnabled, o.CGOEnabled)
+	return strings.Join(diffs, ", ")
+}
+
+// saveToolchain records t in the cache.
+func saveToolchain(s Store, t *toolchain) error {
+	return putBytes(s, toolchainFile, []byte(prettyJSON(t)))
+}
+
+// checkToolchain compares t against the toolchain recorded in the
+// cache, logging any differences. Fingerprints include the toolchain,
+// so a mismatch means restores will miss. The record is read in place
+// where s allows it, which leaves the cache untouched.
+func checkToolchain(s Store, t *toolchain) {
+	b, err := readBytes(s, toolchainFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("unable to read toolchain: %s", err)
+		}
+		return
+	}
+	var saved toolchain
+	if err := json.Unmarshal(b, &saved); err != nil {
+		log.Printf("unable to read toolchain: %s", err)
+		return
+	}
+	if m := t.mismatch(&saved); m != "" {
+		log.Printf("warning: cache was saved by %s, go on PATH is %s (%s)", &saved, t, m)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumKey returns the store key for the checksum of the entry for
+// key.
+func checksumKey(key string) string {
+	return key + ".sha256"
+}
+
+// fileChecksum returns the hex encoded SHA-256 of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readerChecksum(f)
+}
+
+// readerChecksum returns the hex encoded SHA-256 of the contents of r.
+func readerChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A quarantiner is a Store which can set corrupt entries aside for
+// inspection instead of deleting them.
+type quarantiner interface {
+	Quarantine(key string) error
+}
+
+// quarantine removes the corrupt entry for key, and its checksum, from
+// s.
+func quarantine(s Store, key string) error {
+	var err error
+	if q, ok := s.(quarantiner); ok {
+		err = q.Quarantine(key)
+	} else {
+		err = s.Delete(key)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := s.Delete(checksumKey(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Quarantine moves the entry for key into the quarantine subdirectory
+// of the cache directory.
+func (s *dirStore) Quarantine(key string) error {
+	dir := filepath.Join(s.dir, "quarantine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	unlock, err := s.lockEntry(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.Rename(s.find(key), filepath.Join(dir, key))
+}
+
+// checksumStore wraps a Store, storing a SHA-256 checksum alongside
+// each entry and verifying it whenever the entry is read. Sidecar
+// entries, such as manifests, and bookkeeping entries are not
+// checksummed.
+type checksumStore struct {
+	Store
+}
+
+func newChecksumStore(s Store) *checksumStore {
+	return &checksumStore{Store: s}
+}
+
+// A keeper is a Store whose Put leaves an existing entry alone, so
+// the entry it holds after a Put may have been written by another
+// process with different bytes. Keepers read entries in place, which
+// lets the checksum be taken from what was actually stored.
+type keeper interface {
+	opener
+	keepsExisting()
+}
+
+func (s *dirStore) keepsExisting() {}
+
+// Put stores src as the entry for key along with its checksum. The
+// checksum of an entry put into a keeper is taken from what the keeper
+// holds; other stores replace the entry, so src is checksummed rather
+// than read back. Those stores only get a checksum from the Put which
+// added the entry.
+func (s *checksumStore) Put(key, src string) error {
+	if _, sidecar := entryFingerprint(key); sidecar || isBookkeeping(key) {
+		return s.Store.Put(key, src)
+	}
+	k, keeps := s.Store.(keeper)
+	if !keeps {
+		ok, err := s.Store.Has(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	if err := s.Store.Put(key, src); err != nil {
+		return err
+	}
+	var sum string
+	var err error
+	if keeps {
+		var r io.ReadCloser
+		if r, err = k.Open(key); err != nil {
+			return err
+		}
+		sum, err = readerChecksum(r)
+		_ = r.Close()
+	} else {
+		sum, err = fileChecksum(src)
+	}
+	if err != nil {
+		return err
+	}
+	return putBytes(s.Store, checksumKey(key), []byte(sum))
+}
+
+// Get retrieves the entry for key and verifies its checksum. A corrupt
+// entry is quarantined and reported as missing. Entries saved before
+// checksums were introduced have none and are not verified.
+func (s *checksumStore) Get(key, dst string) error {
+	if err := s.Store.Get(key, dst); err != nil {
+		return err
+	}
+	if _, sidecar := entryFingerprint(key); sidecar || isBookkeeping(key) {
+		return nil
+	}
+	ok, err := verifyFile(s.Store, key, dst)
+	if err != nil || ok {
+		return err
+	}
+	_ = os.Remove(dst)
+	log.Printf("%s: checksum mismatch, quarantining", key)
+	// A read-only client, such as one without the token of a cache
+	// server, cannot remove the entry but must still treat it as a
+	// miss.
+	if err := quarantine(s.Store, key); err != nil {
+		log.Printf("%s: unable to quarantine: %s", key, err)
+	}
+	return &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+}
+
+func (s *checksumStore) Delete(key string) error {
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	if err := s.Store.Delete(checksumKey(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// verifyFile returns true if the file at path, holding the entry for
+// key, matches the checksum stored in s or if there is no checksum.
+func verifyFile(s Store, key, path string) (bool, error) {
+	want, err := getBytes(s, checksumKey(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	got, err := fileChecksum(path)
+	if err != nil {
+		return false, err
+	}
+	return got == strings.TrimSpace(string(want)), nil
+}
+
+// verifyEntry returns true if the entry for key in s matches its
+// checksum. The entry and its checksum are read without touching them.
+func verifyEntry(s Store, key string) (bool, error) {
+	want, err := readBytes(s, checksumKey(key))
+	if err != nil {
+		return false, err
+	}
+	r, err := openEntry(s, key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	got, err := readerChecksum(r)
+	if err != nil {
+		return false, err
+	}
+	return got == strings.TrimSpace(string(want)), nil
+}
+
+// verify checks every entry in the cache against its checksum,
+// quarantining the corrupt ones.
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report corrupt entries without removing them")
+	_ = flags.Parse(args)
+
+	// Check the underlying store directly so corrupt entries are
+	// reported here rather than quarantined by checksumStore.Get.
+	// Entries are read in place where possible: verifying an entry is
+	// not a use of it and must not keep it from being evicted.
+	s, err := openStore(cacheLocation())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lockStore(s, !*dryRun)()
+	log.Printf("verifying %s", s)
+	if !*dryRun {
+		removeStoreTemp(s)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys := map[string]bool{}
+	for _, e := range entries {
+		keys[e.Key] = true
+	}
+
+	var checked, corrupt, unverified int
+	for _, e := range entries {
+		if _, sidecar := entryFingerprint(e.Key); sidecar || isBookkeeping(e.Key) {
+			continue
+		}
+		if !keys[checksumKey(e.Key)] {
+			unverified++
+			continue
+		}
+		checked++
+		ok, err := verifyEntry(s, e.Key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ok {
+			continue
+		}
+		corrupt++
+		if *dryRun {
+			log.Printf("%-40s  corrupt", e.Key)
+			continue
+		}
+		log.Printf("%-40s  corrupt, quarantined", e.Key)
+		if err := quarantine(s, e.Key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("%d entries checked: %d corrupt, %d without checksums", checked, corrupt, unverified)
+	if corrupt > 0 && *dryRun {
+		os.Exit(1)
+	}
+}
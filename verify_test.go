@@ -0,0 +1,88 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyEntry(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	if err := ioutil.WriteFile(src, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ds := newDirStore(filepath.Join(tmp, "cache"))
+	if err := newChecksumStore(ds).Put("v2-abcd", src); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verifying an entry must not count as a use of it.
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(ds.find("v2-abcd"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verifyEntry(ds, "v2-abcd"); err != nil || !ok {
+		t.Fatalf("verifyEntry = %v, %v; want true", ok, err)
+	}
+	e, err := ds.Stat("v2-abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.ModTime.Equal(old) {
+		t.Errorf("verifyEntry touched the entry: mtime %s, want %s", e.ModTime, old)
+	}
+
+	if err := ioutil.WriteFile(ds.find("v2-abcd"), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verifyEntry(ds, "v2-abcd"); err != nil || ok {
+		t.Fatalf("verifyEntry of a corrupt entry = %v, %v; want false", ok, err)
+	}
+}
+
+// TestChecksumStorePutExisting checks that a Put which loses to an
+// existing entry with different bytes does not replace its checksum.
+func TestChecksumStorePutExisting(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "build-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s := newChecksumStore(newDirStore(filepath.Join(tmp, "cache")))
+	for i, contents := range []string{"first", "second"} {
+		src := filepath.Join(tmp, "src"+string(rune('0'+i)))
+		if err := ioutil.WriteFile(src, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("v2-abcd", src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := verifyEntry(s.Store, "v2-abcd"); err != nil || !ok {
+		t.Fatalf("verifyEntry = %v, %v; want true", ok, err)
+	}
+}